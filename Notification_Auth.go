@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Пользователь, от имени которого выполняется запрос
+
+type Principal struct {
+	UUID   string
+	Claims *JWT
+}
+
+type principalKey struct{}
+
+// Функция получения токена из заголовка Authorization
+
+func Bearer_Token(r *http.Request) (string, error) {
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return "", errors.New("Authorization header is missing")
+	}
+
+	scheme, token, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(token) == "" {
+		return "", errors.New("Invalid token format")
+	}
+	return strings.TrimSpace(token), nil
+}
+
+// Функция получения токена из заголовка Authorization или параметра token.
+// Браузер не может передать заголовок при открытии WebSocket и EventSource, поэтому
+// только для них токен допускается в URL, остальные эндпоинты требуют заголовок.
+
+func Query_Token(r *http.Request) (string, error) {
+	if r.Header.Get("Authorization") == "" {
+		if token := r.URL.Query().Get("token"); token != "" {
+			return token, nil
+		}
+	}
+	return Bearer_Token(r)
+}
+
+// Интерфейс проверки токена: возвращает пользователя, от имени которого выполняется запрос
+
+type TokenVerifier interface {
+	Verify(token string) (*Principal, error)
+}
+
+// Общая проверка токенов
+
+var verifier TokenVerifier = New_JWT_Verifier()
+
+// Допустимые алгоритмы подписи токена. Токены с "none" и любым другим алгоритмом отклоняются.
+// HS256 проверяется секретом JWT_SECRET, RS* и ES* - ключами из JWKS.
+
+var hmacMethods = []string{jwt.SigningMethodHS256.Alg()}
+
+var keySetMethods = []string{
+	jwt.SigningMethodRS256.Alg(), jwt.SigningMethodRS384.Alg(), jwt.SigningMethodRS512.Alg(),
+	jwt.SigningMethodES256.Alg(), jwt.SigningMethodES384.Alg(), jwt.SigningMethodES512.Alg(),
+}
+
+// Проверка JWT. Если заданы Audience и Issuer, токен должен содержать
+// такие aud и iss, иначе он отклоняется.
+
+type JWT_Verifier struct {
+	Secret   []byte
+	Keys     *Key_Set
+	Audience string
+	Issuer   string
+	Leeway   time.Duration
+}
+
+// Функция создания проверки токенов из окружения: JWT_SECRET, JWKS (JWT_JWKS_URL или JWT_JWKS_FILE),
+// JWT_AUDIENCE, JWT_ISSUER и JWT_LEEWAY - допустимое расхождение часов в секундах
+
+func New_JWT_Verifier() *JWT_Verifier {
+	return &JWT_Verifier{
+		Secret:   []byte(os.Getenv("JWT_SECRET")),
+		Keys:     keySet,
+		Audience: os.Getenv("JWT_AUDIENCE"),
+		Issuer:   os.Getenv("JWT_ISSUER"),
+		Leeway:   time.Duration(Getenv_Int("JWT_LEEWAY", 0)) * time.Second,
+	}
+}
+
+// Функция получения списка алгоритмов, для которых настроены ключи
+
+func (v *JWT_Verifier) methods() []string {
+	var methods []string
+	if v.Keys != nil {
+		methods = append(methods, keySetMethods...)
+	}
+	if len(v.Secret) != 0 {
+		methods = append(methods, hmacMethods...)
+	}
+	return methods
+}
+
+// Функция выбора ключа проверки подписи по алгоритму и kid токена
+
+func (v *JWT_Verifier) key(token *jwt.Token) (interface{}, error) {
+	switch token.Method.(type) {
+	case *jwt.SigningMethodHMAC:
+		if len(v.Secret) == 0 {
+			return nil, errors.New("HMAC tokens are not accepted")
+		}
+		return v.Secret, nil
+
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodECDSA:
+		if v.Keys == nil {
+			return nil, errors.New("JWKS is not configured")
+		}
+		kid, _ := token.Header["kid"].(string)
+		key, err := v.Keys.Key(kid)
+		if err != nil {
+			return nil, err
+		}
+		if key.Alg != "" && key.Alg != token.Method.Alg() {
+			return nil, fmt.Errorf("Key %q is not for %s", kid, token.Method.Alg())
+		}
+		// RSA-ключом нельзя проверить ES-подпись и наоборот
+		switch key.Key.(type) {
+		case *rsa.PublicKey:
+			if _, ok := token.Method.(*jwt.SigningMethodRSA); ok {
+				return key.Key, nil
+			}
+		case *ecdsa.PublicKey:
+			if _, ok := token.Method.(*jwt.SigningMethodECDSA); ok {
+				return key.Key, nil
+			}
+		}
+		return nil, fmt.Errorf("Key %q is not for %s", kid, token.Method.Alg())
+	}
+	return nil, errors.New("Unexpected signing method")
+}
+
+// Функция проверки токена. Для каждого вызова создаются свои claims, проверяются
+// алгоритм подписи, срок действия (exp обязателен), время начала действия (nbf),
+// а также aud и iss, если они настроены.
+
+func (v *JWT_Verifier) Verify(tokenString string) (*Principal, error) {
+	methods := v.methods()
+	if len(methods) == 0 {
+		return nil, errors.New("Neither JWT_SECRET nor JWKS is configured")
+	}
+
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods(methods),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(v.Leeway),
+	}
+	if v.Audience != "" {
+		options = append(options, jwt.WithAudience(v.Audience))
+	}
+	if v.Issuer != "" {
+		options = append(options, jwt.WithIssuer(v.Issuer))
+	}
+
+	claims := &JWT{}
+	if _, err := jwt.ParseWithClaims(tokenString, claims, v.key, options...); err != nil {
+		return nil, err
+	}
+	if claims.Payload.UUID == "" {
+		return nil, errors.New("Token has no uuid")
+	}
+	return &Principal{UUID: claims.Payload.UUID, Claims: claims}, nil
+}
+
+// Функция-обёртка обработчика: проверяет токен из заголовка Authorization и кладёт пользователя в контекст запроса
+
+func Authenticate(next http.Handler) http.Handler {
+	return authenticate(next, Bearer_Token)
+}
+
+// Функция-обёртка для WebSocket и SSE: токен можно передать и параметром token
+
+func Authenticate_Query(next http.Handler) http.Handler {
+	return authenticate(next, Query_Token)
+}
+
+func authenticate(next http.Handler, extract func(r *http.Request) (string, error)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, err := extract(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		principal, err := verifier.Verify(token)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, principal)))
+	})
+}
+
+// Функция получения пользователя из контекста запроса, прошедшего через Authenticate
+
+func Principal_From(ctx context.Context) *Principal {
+	principal, _ := ctx.Value(principalKey{}).(*Principal)
+	return principal
+}
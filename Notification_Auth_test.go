@@ -0,0 +1,249 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Тестовый сервис авторизации: отдаёт JWKS с открытыми ключами keys и считает запросы.
+// Пока failing установлен, отвечает ошибкой, пока hold не закрыт - не отвечает.
+
+type jwksStub struct {
+	*httptest.Server
+	mu       sync.Mutex
+	keys     map[string]*rsa.PublicKey
+	failing  bool
+	hold     chan struct{}
+	requests int32
+}
+
+func newJWKSStub(t *testing.T, keys map[string]*rsa.PublicKey) *jwksStub {
+	t.Helper()
+	stub := &jwksStub{keys: keys}
+	stub.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&stub.requests, 1)
+		stub.mu.Lock()
+		hold := stub.hold
+		stub.mu.Unlock()
+		if hold != nil {
+			<-hold
+		}
+
+		stub.mu.Lock()
+		defer stub.mu.Unlock()
+		if stub.failing {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		var set JWKS
+		for kid, key := range stub.keys {
+			set.Keys = append(set.Keys, JWK{
+				Kty: "RSA",
+				Kid: kid,
+				Alg: jwt.SigningMethodRS256.Alg(),
+				Use: "sig",
+				N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(set)
+	}))
+	t.Cleanup(stub.Close)
+	return stub
+}
+
+func (stub *jwksStub) Requests() int {
+	return int(atomic.LoadInt32(&stub.requests))
+}
+
+// Функция смены ключей сервиса авторизации
+
+func (stub *jwksStub) Rotate(keys map[string]*rsa.PublicKey) {
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+	stub.keys = keys
+}
+
+func (stub *jwksStub) Fail(failing bool) {
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+	stub.failing = failing
+}
+
+// Функция задержки ответов до вызова возвращённой функции
+
+func (stub *jwksStub) Hold() (release func()) {
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+	hold := make(chan struct{})
+	stub.hold = hold
+	return func() {
+		stub.mu.Lock()
+		stub.hold = nil
+		stub.mu.Unlock()
+		close(hold)
+	}
+}
+
+func newRSAKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// Функция подписи токена с uuid пользователя и переданными registered claims
+
+func signToken(t *testing.T, method jwt.SigningMethod, key interface{}, kid string, claims jwt.RegisteredClaims) string {
+	t.Helper()
+	var payload JWT
+	payload.Payload.UUID = "3f1c2a9e-5b7d-4e8f-9a0b-1c2d3e4f5a6b"
+	payload.RegisteredClaims = claims
+	token := jwt.NewWithClaims(method, payload)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestJWTVerifierVerify(t *testing.T) {
+	t.Setenv("JWT_JWKS_MIN_REFRESH", "0")
+
+	secret := []byte("test-secret")
+	trusted := newRSAKey(t)
+	untrusted := newRSAKey(t)
+	stub := newJWKSStub(t, map[string]*rsa.PublicKey{"trusted": &trusted.PublicKey})
+
+	verifier := &JWT_Verifier{
+		Secret:   secret,
+		Keys:     New_Key_Set(stub.URL, ""),
+		Audience: "notifications",
+		Issuer:   "https://auth.example.com",
+	}
+
+	now := time.Now()
+	valid := jwt.RegisteredClaims{
+		Issuer:    "https://auth.example.com",
+		Audience:  jwt.ClaimStrings{"notifications"},
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+	}
+	with := func(change func(claims *jwt.RegisteredClaims)) jwt.RegisteredClaims {
+		claims := valid
+		change(&claims)
+		return claims
+	}
+
+	none, err := jwt.NewWithClaims(jwt.SigningMethodNone, valid).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"valid HS256", signToken(t, jwt.SigningMethodHS256, secret, "", valid), true},
+		{"valid RS256", signToken(t, jwt.SigningMethodRS256, trusted, "trusted", valid), true},
+		{"expired", signToken(t, jwt.SigningMethodHS256, secret, "", with(func(c *jwt.RegisteredClaims) {
+			c.ExpiresAt = jwt.NewNumericDate(now.Add(-time.Minute))
+		})), false},
+		{"no exp", signToken(t, jwt.SigningMethodHS256, secret, "", with(func(c *jwt.RegisteredClaims) {
+			c.ExpiresAt = nil
+		})), false},
+		{"wrong secret", signToken(t, jwt.SigningMethodHS256, []byte("other-secret"), "", valid), false},
+		{"HS512", signToken(t, jwt.SigningMethodHS512, secret, "", valid), false},
+		{"RS256 signed by a key not in the set", signToken(t, jwt.SigningMethodRS256, untrusted, "untrusted", valid), false},
+		{"RS256 with a trusted kid signed by another key", signToken(t, jwt.SigningMethodRS256, untrusted, "trusted", valid), false},
+		{"alg none", none, false},
+		{"wrong aud", signToken(t, jwt.SigningMethodHS256, secret, "", with(func(c *jwt.RegisteredClaims) {
+			c.Audience = jwt.ClaimStrings{"billing"}
+		})), false},
+		{"no aud", signToken(t, jwt.SigningMethodHS256, secret, "", with(func(c *jwt.RegisteredClaims) {
+			c.Audience = nil
+		})), false},
+		{"wrong iss", signToken(t, jwt.SigningMethodHS256, secret, "", with(func(c *jwt.RegisteredClaims) {
+			c.Issuer = "https://evil.example.com"
+		})), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			principal, err := verifier.Verify(tt.token)
+			if tt.ok {
+				if err != nil {
+					t.Fatalf("Verify() error = %v, want nil", err)
+				}
+				if principal.UUID != "3f1c2a9e-5b7d-4e8f-9a0b-1c2d3e4f5a6b" {
+					t.Fatalf("Verify() uuid = %q", principal.UUID)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("Verify() accepted the token, want an error")
+			}
+		})
+	}
+}
+
+func TestJWTVerifierWithoutAudience(t *testing.T) {
+	secret := []byte("test-secret")
+	verifier := &JWT_Verifier{Secret: secret}
+
+	token := signToken(t, jwt.SigningMethodHS256, secret, "", jwt.RegisteredClaims{
+		Audience:  jwt.ClaimStrings{"anything"},
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+	})
+	if _, err := verifier.Verify(token); err != nil {
+		t.Fatalf("Verify() error = %v, aud must not be checked without JWT_AUDIENCE", err)
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	tests := []struct {
+		name    string
+		target  string
+		header  string
+		extract func(r *http.Request) (string, error)
+		want    string
+		ok      bool
+	}{
+		{"header", "/api", "Bearer abc", Bearer_Token, "abc", true},
+		{"lowercase scheme", "/api", "bearer abc", Bearer_Token, "abc", true},
+		{"basic scheme", "/api", "Basic abc", Bearer_Token, "", false},
+		{"query is ignored", "/api?token=abc", "", Bearer_Token, "", false},
+		{"query for streams", "/api/ws?token=abc", "", Query_Token, "abc", true},
+		{"header wins over query", "/api/ws?token=abc", "Bearer def", Query_Token, "def", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			token, err := tt.extract(r)
+			if (err == nil) != tt.ok || token != tt.want {
+				t.Fatalf("got (%q, %v), want %q", token, err, tt.want)
+			}
+		})
+	}
+}
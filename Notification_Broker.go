@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Состояния соединения с RabbitMQ
+
+const (
+	BrokerConnecting   = "connecting"
+	BrokerConnected    = "connected"
+	BrokerReconnecting = "reconnecting"
+	BrokerClosed       = "closed"
+)
+
+var ErrBrokerDisconnected = errors.New("RabbitMQ is not connected")
+
+// Структура состояния соединения для /health
+
+type BrokerStatus struct {
+	State      string    `json:"state"`
+	Since      time.Time `json:"since"`
+	Reconnects int       `json:"reconnects"`
+	Last_error string    `json:"last_error,omitempty"`
+}
+
+// Структура, которая держит соединение с RabbitMQ и переподключается при его потере
+
+type Broker struct {
+	mu     sync.RWMutex
+	conn   *amqp.Connection
+	ready  chan struct{}
+	done   chan struct{}
+	once   sync.Once
+	status BrokerStatus
+
+	// канал для публикации, общий для всех отправителей
+	pubMu     sync.Mutex
+	publisher *amqp.Channel
+}
+
+// Общее соединение с RabbitMQ для консьюмеров и админки
+
+var broker = New_Broker()
+
+func New_Broker() *Broker {
+	return &Broker{
+		ready:  make(chan struct{}),
+		done:   make(chan struct{}),
+		status: BrokerStatus{State: BrokerConnecting, Since: time.Now()},
+	}
+}
+
+// Функция расчёта паузы перед очередной попыткой: 1s, 2s, 4s ... до NOTIF_RECONNECT_MAX секунд
+
+func Backoff(attempt int) time.Duration {
+	maxDelay := time.Duration(Getenv_Int("NOTIF_RECONNECT_MAX", 30)) * time.Second
+	if attempt > 16 {
+		return maxDelay
+	}
+	delay := time.Second << attempt
+	if delay > maxDelay {
+		return maxDelay
+	}
+	return delay
+}
+
+// Функция смены состояния соединения с записью в лог
+
+func (b *Broker) setState(state string, err error) {
+	b.status.State = state
+	b.status.Since = time.Now()
+	if err != nil {
+		b.status.Last_error = err.Error()
+		log.Printf("RabbitMQ %s: %v", state, err)
+	} else {
+		log.Printf("RabbitMQ %s", state)
+	}
+}
+
+// Функция поддержания соединения: подключается с экспоненциальной паузой
+// и ждёт NotifyClose, после чего подключается заново. Завершается после Close.
+
+func (b *Broker) Run() {
+	for attempt := 0; ; {
+		conn, err := Dial_RabbitMQ()
+		if err != nil {
+			delay := Backoff(attempt)
+			b.mu.Lock()
+			b.setState(BrokerReconnecting, err)
+			b.mu.Unlock()
+			attempt++
+			select {
+			case <-time.After(delay):
+				continue
+			case <-b.done:
+				return
+			}
+		}
+		attempt = 0
+
+		closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+
+		b.mu.Lock()
+		select {
+		case <-b.done:
+			//Close вызван, пока шло подключение
+			b.mu.Unlock()
+			conn.Close()
+			return
+		default:
+		}
+		b.conn = conn
+		b.setState(BrokerConnected, nil)
+		close(b.ready)
+		b.mu.Unlock()
+
+		closeErr := <-closed
+
+		select {
+		case <-b.done:
+			return
+		default:
+		}
+
+		b.mu.Lock()
+		b.conn = nil
+		b.ready = make(chan struct{})
+		b.status.Reconnects++
+		if closeErr != nil {
+			b.setState(BrokerReconnecting, closeErr)
+		} else {
+			b.setState(BrokerReconnecting, errors.New("connection closed"))
+		}
+		b.mu.Unlock()
+	}
+}
+
+// Функция ожидания соединения, возвращает ошибку контекста, если он завершился раньше
+
+func (b *Broker) Wait(ctx context.Context) error {
+	b.mu.RLock()
+	ready := b.ready
+	b.mu.RUnlock()
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Функция закрытия соединения при остановке сервиса, переподключения после неё не будет
+
+func (b *Broker) Close() {
+	b.once.Do(func() {
+		b.mu.Lock()
+		close(b.done)
+		conn := b.conn
+		b.conn = nil
+		b.setState(BrokerClosed, nil)
+		b.mu.Unlock()
+		if conn != nil {
+			if err := conn.Close(); err != nil {
+				log.Printf("Failed to close RabbitMQ connection: %v", err)
+			}
+		}
+	})
+}
+
+// Функция открытия канала на текущем соединении, не ждёт переподключения
+
+func (b *Broker) Channel() (*amqp.Channel, error) {
+	b.mu.RLock()
+	conn := b.conn
+	b.mu.RUnlock()
+	if conn == nil {
+		return nil, ErrBrokerDisconnected
+	}
+	return conn.Channel()
+}
+
+// Функция публикации сообщения через общий канал. Канал открывается при первой
+// публикации и открывается заново, если он или соединение были закрыты.
+
+func (b *Broker) Publish(ctx context.Context, exchange string, key string, msg amqp.Publishing) error {
+	b.pubMu.Lock()
+	defer b.pubMu.Unlock()
+
+	if b.publisher == nil || b.publisher.IsClosed() {
+		ch, err := b.Channel()
+		if err != nil {
+			return err
+		}
+		b.publisher = ch
+	}
+	return b.publisher.PublishWithContext(ctx, exchange, key, false, false, msg)
+}
+
+// Функция получения состояния соединения
+
+func (b *Broker) Status() BrokerStatus {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return b.status
+}
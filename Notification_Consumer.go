@@ -0,0 +1,584 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Событие, принятое из RabbitMQ. Каждый тип события сам знает, кому адресовано уведомление.
+
+type Event interface {
+	Recipients() []string
+}
+
+// Событие, которому нужно сохранить дополнительные данные в той же транзакции, что и уведомления
+
+type Saver interface {
+	Save(tx *sql.Tx) error
+}
+
+// Событие, которое нужно проверить перед сохранением. Ошибка проверки не исправится
+// повторной попыткой, поэтому такое сообщение сразу уходит в очередь "мёртвых" сообщений.
+
+type Validator interface {
+	Validate() error
+}
+
+// Структура обработчика события: из какой очереди и по какому ключу
+// читать сообщения, во что их распаковывать и с каким target сохранять
+
+type EventHandler struct {
+	Queue      string
+	RoutingKey string
+	Target     string
+	New        func() Event
+	// Сколько неподтверждённых сообщений брокер может выдать консьюмеру,
+	// переопределяется NOTIF_PREFETCH_<QUEUE>, если 0 - берётся NOTIF_PREFETCH
+	Prefetch int
+	// Отправлять ли уведомление на почту, без него канал email для target
+	// не показывается в настройках и не принимается
+	Email bool
+}
+
+// Зарегистрированные обработчики событий
+
+var handlers []EventHandler
+
+// Функция регистрации обработчика события
+
+func Register_Handler(handler EventHandler) {
+	handlers = append(handlers, handler)
+}
+
+// Функция запуска консьюмеров всех зарегистрированных обработчиков
+// на одном соединении с RabbitMQ и общем пуле соединений с базой данных.
+// Работает до завершения ctx.
+
+func Run_Consumers(ctx context.Context, db *sql.DB, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	//поддерживаем connection, переподключаемся при потере
+	go broker.Run()
+
+	//отправляем письма в отдельной горутине
+	go mailer.Run()
+
+	//и push-уведомления на устройства
+	go pusher.Run(db)
+
+	//и вебхуки внешним системам
+	go webhooks.Run(db)
+
+	var consumers sync.WaitGroup
+
+	//и накопившиеся сводки по расписанию
+	consumers.Add(1)
+	go func() {
+		defer consumers.Done()
+		Run_Digests(ctx, db)
+	}()
+
+	//рассылка уведомлений клиентам, подключённым к любому экземпляру
+	consumers.Add(1)
+	go func() {
+		defer consumers.Done()
+		Supervise_Fanout(ctx)
+	}()
+
+	for _, handler := range handlers {
+		consumers.Add(1)
+		go func(handler EventHandler) {
+			defer consumers.Done()
+			Supervise_Consumer(ctx, db, handler)
+		}(handler)
+	}
+
+	//при остановке ждём, пока консьюмеры подтвердят или вернут в очередь полученные сообщения
+	consumers.Wait()
+
+	//письма, push и вебхуки в очередях уже подтверждены в RabbitMQ, поэтому дожидаемся их отправки,
+	//и только потом закрываем соединение и (в main) базу данных
+	stopCtx, cancel := context.WithTimeout(context.Background(), Shutdown_Timeout())
+	defer cancel()
+	var dispatchers sync.WaitGroup
+	for _, stop := range []func(context.Context) error{mailer.Stop, pusher.Stop, webhooks.Stop} {
+		dispatchers.Add(1)
+		go func(stop func(context.Context) error) {
+			defer dispatchers.Done()
+			stop(stopCtx)
+		}(stop)
+	}
+	dispatchers.Wait()
+
+	broker.Close()
+	log.Printf("Consumers stopped")
+}
+
+// Функция поддержания консьюмера обработчика. Когда канал или соединение
+// закрываются, канал открывается заново, а очередь и binding объявляются повторно.
+// Завершается после остановки консьюмера по ctx.
+
+func Supervise_Consumer(ctx context.Context, db *sql.DB, handler EventHandler) {
+	for attempt := 0; ; {
+		if err := broker.Wait(ctx); err != nil {
+			return
+		}
+
+		//для каждого обработчика свой канал на общем соединении
+		ch, err := broker.Channel()
+		if err == nil {
+			var msgs <-chan amqp.Delivery
+			msgs, err = Declare_Consumer(ch, handler)
+			if err == nil {
+				attempt = 0
+				log.Printf("Consumer %s started", handler.Queue)
+				Consume_Loop(ctx, db, ch, handler, msgs)
+				log.Printf("Consumer %s stopped", handler.Queue)
+			}
+			ch.Close()
+		}
+		if err != nil {
+			log.Printf("Failed to start consumer %s: %v", handler.Queue, err)
+		}
+
+		select {
+		case <-time.After(Backoff(attempt)):
+		case <-ctx.Done():
+			return
+		}
+		attempt++
+	}
+}
+
+// Функция подключения к RabbitMQ
+
+func Dial_RabbitMQ() (*amqp.Connection, error) {
+	return amqp.Dial("amqp://" + os.Getenv("RABBITMQ_USER") + ":" + os.Getenv("RABBITMQ_PASS") + "@" + os.Getenv("RABBITMQ_ADDR"))
+}
+
+// Тег консьюмера, по нему подписка отменяется при остановке
+
+const consumerTag = "Notification_DB"
+
+// Функция объявления exchange, очереди и binding для обработчика и подписки на очередь
+
+func Declare_Consumer(ch *amqp.Channel, handler EventHandler) (<-chan amqp.Delivery, error) {
+	//создаём Exchange и очередь для сообщений, которые не удалось обработать
+	if err := Declare_Dead_Letter(ch); err != nil {
+		return nil, err
+	}
+	//и Exchange рассылки сохранённых уведомлений по экземплярам
+	if err := Declare_Fanout(ch); err != nil {
+		return nil, err
+	}
+
+	//создаём Exchange
+	err := ch.ExchangeDeclare(
+		"main",  // name
+		"topic", // type
+		true,    // durable
+		false,   // auto-deleted
+		false,   // internal
+		false,   // no-wait
+		nil,     // arguments
+	)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to declare an exchange: %w", err)
+	}
+	//создаём очередь Queue
+	q, err := ch.QueueDeclare(
+		handler.Queue, // name
+		true,          // durable
+		false,         // delete when unused
+		false,         // exclusive
+		false,         // no-wait
+		nil,           // arguments
+	)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to declare a queue: %w", err)
+	}
+
+	//делаем Binding Queue
+	err = ch.QueueBind(
+		q.Name,             // queue name
+		handler.RoutingKey, // routing key
+		"main",             // exchange
+		false,
+		nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to bind a queue: %w", err)
+	}
+
+	//создаём очередь отложенных повторных попыток
+	if err := Declare_Retry(ch, handler); err != nil {
+		return nil, err
+	}
+
+	//повторные попытки и "мёртвые" сообщения публикуются с подтверждением брокера
+	if err := ch.Confirm(false); err != nil {
+		return nil, fmt.Errorf("Failed to put a channel into confirm mode: %w", err)
+	}
+
+	//ограничиваем количество неподтверждённых сообщений
+	err = ch.Qos(
+		Prefetch(handler), // prefetch count
+		0,                 // prefetch size
+		false,             // global
+	)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to set QoS: %w", err)
+	}
+
+	//Получаемое сообщение, подтверждаем вручную после сохранения в базе данных
+	msgs, err := ch.Consume(
+		q.Name,      // queue
+		consumerTag, // consumer
+		false,       // auto-ack
+		false,       // exclusive
+		false,       // no-local
+		false,       // no-wait
+		nil,         // args
+	)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to register a consumer: %w", err)
+	}
+
+	return msgs, nil
+}
+
+// Функция получения prefetch консьюмера: NOTIF_PREFETCH_<QUEUE> (имя очереди в верхнем регистре),
+// затем Prefetch обработчика, затем общий NOTIF_PREFETCH
+
+func Prefetch(handler EventHandler) int {
+	prefetch := handler.Prefetch
+	if prefetch == 0 {
+		prefetch = Getenv_Int("NOTIF_PREFETCH", 10)
+	}
+	return Getenv_Int("NOTIF_PREFETCH_"+strings.ToUpper(handler.Queue), prefetch)
+}
+
+// Обрабатываем полученные сообщения и сохраняем их в базе данных.
+// Сообщение подтверждается только после commit транзакции. При временной
+// ошибке базы данных оно откладывается в очередь повторных попыток, а сообщения, которые
+// не удалось разобрать или сохранить, уходят в очередь "мёртвых" сообщений.
+// При остановке сервиса текущее сообщение дообрабатывается, остальные возвращаются в очередь.
+
+func Consume_Loop(ctx context.Context, db *sql.DB, ch *amqp.Channel, handler EventHandler, msgs <-chan amqp.Delivery) {
+	for {
+		var d amqp.Delivery
+		select {
+		case delivery, ok := <-msgs:
+			if !ok {
+				return
+			}
+			d = delivery
+		case <-ctx.Done():
+			Drain_Consumer(ch, handler, msgs)
+			return
+		}
+
+		event := handler.New()
+		err := json.Unmarshal(d.Body, event)
+		if err != nil {
+			Dead_Letter(ch, handler, d, fmt.Errorf("Failed to unmarshal message: %w", err))
+			continue
+		}
+		if validator, ok := event.(Validator); ok {
+			if err := validator.Validate(); err != nil {
+				Dead_Letter(ch, handler, d, fmt.Errorf("Invalid message: %w", err))
+				continue
+			}
+		}
+
+		stored, err := Store_Event(db, handler, d, event)
+		if err != nil {
+			err = fmt.Errorf("Failed to insert message into database: %w", err)
+			if Is_Transient(err) {
+				log.Printf("%s: %v, retry", handler.Queue, err)
+				Retry(ch, handler, d, err)
+			} else {
+				Dead_Letter(ch, handler, d, err)
+			}
+			continue
+		}
+		if err := d.Ack(false); err != nil {
+			log.Printf("Failed to ack message from %s: %v", handler.Queue, err)
+		}
+
+		for _, notification := range stored {
+			if notification.Digest {
+				continue
+			}
+			Deliver_Notification(db, notification)
+		}
+	}
+}
+
+// Функция остановки консьюмера: RabbitMQ перестаёт присылать новые сообщения,
+// а уже полученные, но не обработанные, возвращаются в очередь
+
+func Drain_Consumer(ch *amqp.Channel, handler EventHandler, msgs <-chan amqp.Delivery) {
+	if err := ch.Cancel(consumerTag, false); err != nil {
+		//канал уже закрыт, неподтверждённые сообщения RabbitMQ вернёт в очередь сам
+		log.Printf("Failed to cancel consumer %s: %v", handler.Queue, err)
+		return
+	}
+	for d := range msgs {
+		if err := d.Nack(false, true); err != nil {
+			log.Printf("Failed to requeue message from %s: %v", handler.Queue, err)
+		}
+	}
+}
+
+// Функция отправки сохранённого уведомления подключённым клиентам, на почту, на устройства
+// и внешним системам, если пользователь их не отключил. Каналы, недоступные для target,
+// в настройках не включаются (Supports_Channel).
+
+func Deliver_Notification(db *sql.DB, notification Stored_Notification) {
+	if notification.Channels[ChannelInApp] {
+		Publish_Notification(notification.FromDB)
+	}
+	if notification.Channels[ChannelEmail] {
+		Email_Notification(db, notification.FromDB)
+	}
+	if notification.Channels[ChannelPush] {
+		pusher.Enqueue(notification.FromDB)
+	}
+	if notification.Channels[ChannelWebhook] {
+		webhooks.Enqueue(notification.FromDB)
+	}
+}
+
+// Структура остановки фоновой очереди доставки (письма, push, вебхуки). Уведомления
+// в таких очередях уже подтверждены в RabbitMQ и при потере не вернутся, поэтому при остановке
+// очередь перестаёт принимать новые уведомления и дорабатывает принятые до конца срока остановки.
+// Если срок вышел, Abort завершается и текущие отправки прерываются.
+
+type Delivery_Queue struct {
+	name    string
+	mu      sync.RWMutex
+	stopped bool
+	done    chan struct{}
+	Abort   context.Context
+	cancel  context.CancelFunc
+}
+
+func New_Delivery_Queue(name string) *Delivery_Queue {
+	abort, cancel := context.WithCancel(context.Background())
+	return &Delivery_Queue{name: name, done: make(chan struct{}), Abort: abort, cancel: cancel}
+}
+
+// Функция постановки в очередь: enqueue вызывается, только если очередь ещё не остановлена
+
+func (q *Delivery_Queue) Accept(enqueue func()) bool {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.stopped {
+		return false
+	}
+	enqueue()
+	return true
+}
+
+// Функция, которую Run очереди вызывает при завершении
+
+func (q *Delivery_Queue) Finish() {
+	close(q.done)
+}
+
+// Функция остановки очереди: closeQueue закрывает канал очереди, после чего Run
+// дорабатывает оставшиеся уведомления и завершается. pending - сколько уведомлений осталось.
+
+func (q *Delivery_Queue) Stop(ctx context.Context, closeQueue func(), pending func() int) error {
+	q.mu.Lock()
+	if !q.stopped {
+		q.stopped = true
+		closeQueue()
+	}
+	q.mu.Unlock()
+
+	select {
+	case <-q.done:
+		log.Printf("%s queue drained", q.name)
+		return nil
+	case <-ctx.Done():
+		log.Printf("%s queue was not drained before shutdown, %d dropped", q.name, pending())
+		q.cancel()
+		<-q.done
+		return ctx.Err()
+	}
+}
+
+// Функция определения идентификатора события: MessageId из AMQP,
+// а если издатель его не указал - хеш исходного ключа маршрутизации и тела сообщения.
+// Повторная попытка приходит с ключом, равным имени очереди, поэтому исходный ключ
+// берётся из заголовка x-original-routing-key.
+
+func Event_ID(d amqp.Delivery) string {
+	if d.MessageId != "" {
+		return d.MessageId
+	}
+	routingKey := d.RoutingKey
+	if original, ok := d.Headers[headerOriginalRoutingKey].(string); ok {
+		routingKey = original
+	}
+	sum := sha256.Sum256(append([]byte(routingKey+"\n"), d.Body...))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// Поля сообщения, из которых берётся время события, если издатель не указал AMQP Timestamp
+
+var eventTimeFields = []string{"event_time", "timestamp", "created_at", "occurred_at"}
+
+// Функция определения времени исходного события: AMQP Timestamp или поле
+// сообщения в формате RFC3339 либо unix-времени. Если времени нет, возвращается nil.
+
+func Event_Time(d amqp.Delivery) *time.Time {
+	if !d.Timestamp.IsZero() {
+		eventTime := d.Timestamp.UTC()
+		return &eventTime
+	}
+
+	var payload map[string]interface{}
+	if err := json.Unmarshal(d.Body, &payload); err != nil {
+		return nil
+	}
+	for _, field := range eventTimeFields {
+		switch value := payload[field].(type) {
+		case string:
+			if eventTime, err := time.Parse(time.RFC3339, value); err == nil {
+				return &eventTime
+			}
+		case float64:
+			// unix-время в секундах или миллисекундах
+			eventTime := time.Unix(int64(value), 0)
+			if value > 1e12 {
+				eventTime = time.UnixMilli(int64(value))
+			}
+			eventTime = eventTime.UTC()
+			return &eventTime
+		}
+	}
+	return nil
+}
+
+// Уведомление получателя и каналы, в которые его нужно доставить.
+// Digest - уведомление отложено до отправки сводки.
+
+type Stored_Notification struct {
+	FromDB
+	Channels map[string]bool
+	Digest   bool
+}
+
+// Функция сохранения уведомлений всех получателей события в одной транзакции.
+// Если пользователь отключил для target уведомления в приложении, уведомление
+// не сохраняется, но возвращается для доставки в остальные включённые каналы, а событие
+// запоминается в delivered_events. Если событие этому получателю уже сохранено или
+// доставлено, получатель пропускается, и письмо, push и вебхук не отправляются повторно.
+// Если пользователь включил для target сводку, уведомление сохраняется и ставится в очередь сводки.
+
+func Store_Event(db *sql.DB, handler EventHandler, d amqp.Delivery, event Event) ([]Stored_Notification, error) {
+	eventID := Event_ID(d)
+	eventTime := Event_Time(d)
+	recipients := event.Recipients()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if saver, ok := event.(Saver); ok {
+		if err := saver.Save(tx); err != nil {
+			return nil, err
+		}
+	}
+
+	stored := make([]Stored_Notification, 0, len(recipients))
+	for _, uuid := range recipients {
+		preferences, err := Resolve_Preferences(tx, uuid, []string{handler.Target})
+		if err != nil {
+			return nil, err
+		}
+		channels := preferences[handler.Target]
+
+		if !channels[ChannelInApp] {
+			result, err := tx.Exec("INSERT INTO delivered_events (event_id, uuid) VALUES ($1, $2) ON CONFLICT (event_id, uuid) DO NOTHING", eventID, uuid)
+			if err != nil {
+				return nil, err
+			}
+			if inserted, err := result.RowsAffected(); err != nil {
+				return nil, err
+			} else if inserted == 0 {
+				log.Printf("Duplicate event %s for %s skipped", eventID, uuid)
+				continue
+			}
+			stored = append(stored, Stored_Notification{
+				FromDB: FromDB{
+					UUID:         uuid,
+					Notification: string(d.Body),
+					Target:       handler.Target,
+					Created_at:   time.Now(),
+					Event_time:   eventTime,
+				},
+				Channels: channels,
+			})
+			continue
+		}
+
+		row := tx.QueryRow("INSERT INTO notification_registration (uuid, notification, target, event_id, event_time) VALUES ($1, $2, $3, $4, $5) ON CONFLICT (event_id, uuid) DO NOTHING RETURNING "+notificationColumns, uuid, string(d.Body), handler.Target, eventID, eventTime)
+		registration, err := Scan_Notification(row)
+		if err == sql.ErrNoRows {
+			log.Printf("Duplicate event %s for %s skipped", eventID, uuid)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		frequency, err := Digest_Frequency(tx, uuid, handler.Target)
+		if err != nil {
+			return nil, err
+		}
+		if frequency != "" {
+			if _, err := tx.Exec("INSERT INTO digest_items (notification_id, frequency) VALUES ($1, $2)", registration.Notification_id, frequency); err != nil {
+				return nil, err
+			}
+		}
+
+		stored = append(stored, Stored_Notification{FromDB: registration, Channels: channels, Digest: frequency != ""})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return stored, nil
+}
+
+// Функция определения временной ошибки базы данных.
+// Ошибки данных (класс 22) и нарушения ограничений (класс 23) не исправятся
+// повторной попыткой, остальные считаются временными.
+
+func Is_Transient(err error) bool {
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code.Class() {
+		case "22", "23":
+			return false
+		}
+	}
+	return true
+}
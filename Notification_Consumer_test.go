@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestEventID(t *testing.T) {
+	body := []byte(`{"project_id": 1, "user_uuid": "3f1c2a9e-5b7d-4e8f-9a0b-1c2d3e4f5a6b"}`)
+	original := amqp.Delivery{Exchange: "main", RoutingKey: "project.join_request", Body: body}
+
+	// повторная попытка приходит из очереди повторных попыток с ключом, равным имени очереди
+	handler := EventHandler{Queue: "Notification_ProjectJoinRequest"}
+	retried := amqp.Delivery{Exchange: "", RoutingKey: handler.Queue, Body: body, Headers: withOrigin(original, handler)}
+	retried.Headers[headerRetryCount] = int32(1)
+
+	if Event_ID(retried) != Event_ID(original) {
+		t.Errorf("retried delivery id %s, want %s", Event_ID(retried), Event_ID(original))
+	}
+
+	withMessageID := original
+	withMessageID.MessageId = "message-1"
+	if id := Event_ID(withMessageID); id != "message-1" {
+		t.Errorf("Event_ID() = %s, want MessageId", id)
+	}
+	retriedWithMessageID := retried
+	retriedWithMessageID.MessageId = "message-1"
+	if id := Event_ID(retriedWithMessageID); id != "message-1" {
+		t.Errorf("retried Event_ID() = %s, want MessageId", id)
+	}
+
+	otherKey := original
+	otherKey.RoutingKey = "project.negotiation.created"
+	if Event_ID(otherKey) == Event_ID(original) {
+		t.Error("deliveries with different routing keys and the same body have the same id")
+	}
+}
@@ -0,0 +1,428 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Exchange и очередь для сообщений, которые не удалось обработать
+
+const (
+	deadLetterExchange = "notification.dlx"
+	deadLetterQueue    = "Notification_DeadLetter"
+)
+
+// Заголовки, в которых хранится причина и место ошибки
+
+const (
+	headerFailureReason      = "x-failure-reason"
+	headerFailedAt           = "x-failed-at"
+	headerOriginalQueue      = "x-original-queue"
+	headerOriginalExchange   = "x-original-exchange"
+	headerOriginalRoutingKey = "x-original-routing-key"
+	headerRetryCount         = "x-retry-count"
+)
+
+// Функция объявления exchange и очереди для "мёртвых" сообщений
+
+func Declare_Dead_Letter(ch *amqp.Channel) error {
+	err := ch.ExchangeDeclare(
+		deadLetterExchange, // name
+		"fanout",           // type
+		true,               // durable
+		false,              // auto-deleted
+		false,              // internal
+		false,              // no-wait
+		nil,                // arguments
+	)
+	if err != nil {
+		return fmt.Errorf("Failed to declare a dead letter exchange: %w", err)
+	}
+
+	q, err := ch.QueueDeclare(
+		deadLetterQueue, // name
+		true,            // durable
+		false,           // delete when unused
+		false,           // exclusive
+		false,           // no-wait
+		nil,             // arguments
+	)
+	if err != nil {
+		return fmt.Errorf("Failed to declare a dead letter queue: %w", err)
+	}
+
+	err = ch.QueueBind(q.Name, "", deadLetterExchange, false, nil)
+	if err != nil {
+		return fmt.Errorf("Failed to bind a dead letter queue: %w", err)
+	}
+	return nil
+}
+
+// Функция чтения количества повторных попыток из заголовков сообщения
+
+func Retry_Count(d amqp.Delivery) int {
+	switch count := d.Headers[headerRetryCount].(type) {
+	case int32:
+		return int(count)
+	case int64:
+		return int(count)
+	}
+	return 0
+}
+
+// Функция копирования сообщения для повторной публикации
+
+func republished(d amqp.Delivery, headers amqp.Table) amqp.Publishing {
+	return amqp.Publishing{
+		Headers:         headers,
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		DeliveryMode:    amqp.Persistent,
+		MessageId:       d.MessageId,
+		Timestamp:       d.Timestamp,
+		Type:            d.Type,
+		AppId:           d.AppId,
+		Body:            d.Body,
+	}
+}
+
+// Функция копирования заголовков сообщения
+
+func copyHeaders(headers amqp.Table) amqp.Table {
+	copied := amqp.Table{}
+	for key, value := range headers {
+		copied[key] = value
+	}
+	return copied
+}
+
+// Функция сохранения в заголовках, откуда сообщение пришло изначально.
+// При повторной попытке сообщение публикуется в очередь повторных попыток, поэтому
+// исходные exchange и ключ маршрутизации запоминаются только один раз.
+
+func withOrigin(d amqp.Delivery, handler EventHandler) amqp.Table {
+	headers := copyHeaders(d.Headers)
+	if _, ok := headers[headerOriginalRoutingKey]; !ok {
+		headers[headerOriginalQueue] = handler.Queue
+		headers[headerOriginalExchange] = d.Exchange
+		headers[headerOriginalRoutingKey] = d.RoutingKey
+	}
+	return headers
+}
+
+// Имя очереди отложенных повторных попыток обработчика
+
+func retryQueue(handler EventHandler) string {
+	return handler.Queue + ".retry"
+}
+
+// Функция объявления очереди отложенных повторных попыток. У очереди нет консьюмеров:
+// сообщение лежит в ней до истечения своего Expiration, после чего RabbitMQ
+// перекладывает его обратно в очередь обработчика.
+
+func Declare_Retry(ch *amqp.Channel, handler EventHandler) error {
+	_, err := ch.QueueDeclare(
+		retryQueue(handler), // name
+		true,                // durable
+		false,               // delete when unused
+		false,               // exclusive
+		false,               // no-wait
+		amqp.Table{
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": handler.Queue,
+		},
+	)
+	if err != nil {
+		return fmt.Errorf("Failed to declare a retry queue: %w", err)
+	}
+	return nil
+}
+
+// Функция отложенной повторной попытки: сообщение с увеличенным счётчиком попыток
+// публикуется в очередь повторных попыток и вернётся в очередь обработчика после паузы.
+// Консьюмер при этом продолжает обрабатывать остальные сообщения.
+// Если попытки закончились, сообщение отправляется в очередь "мёртвых" сообщений.
+
+func Retry(ch *amqp.Channel, handler EventHandler, d amqp.Delivery, reason error) {
+	retries := Retry_Count(d)
+	if retries >= Getenv_Int("NOTIF_MAX_RETRIES", 10) {
+		Dead_Letter(ch, handler, d, reason)
+		return
+	}
+
+	// экспоненциальная пауза, чтобы не крутить сообщение в цикле, пока база недоступна
+	delay := time.Second << retries
+	if delay > 30*time.Second {
+		delay = 30 * time.Second
+	}
+
+	headers := withOrigin(d, handler)
+	headers[headerRetryCount] = int32(retries + 1)
+	headers[headerFailureReason] = reason.Error()
+
+	publishing := republished(d, headers)
+	publishing.Expiration = strconv.FormatInt(delay.Milliseconds(), 10)
+
+	err := Publish_Confirmed(context.Background(), ch, "", retryQueue(handler), publishing)
+	if err != nil {
+		log.Printf("Failed to requeue message from %s: %v", handler.Queue, err)
+		d.Nack(false, true)
+		return
+	}
+	d.Ack(false)
+}
+
+// Функция отправки сообщения в очередь "мёртвых" сообщений с причиной ошибки в заголовках
+
+func Dead_Letter(ch *amqp.Channel, handler EventHandler, d amqp.Delivery, reason error) {
+	log.Printf("Dead-lettering message from %s: %v", handler.Queue, reason)
+
+	headers := withOrigin(d, handler)
+	headers[headerFailureReason] = reason.Error()
+	headers[headerFailedAt] = time.Now().UTC().Format(time.RFC3339)
+
+	// по message_id сообщение находится в админке
+	publishing := republished(d, headers)
+	if publishing.MessageId == "" {
+		publishing.MessageId = newMessageID()
+	}
+
+	err := Publish_Confirmed(context.Background(), ch, deadLetterExchange, "", publishing)
+	if err != nil {
+		log.Printf("Failed to dead-letter message from %s: %v", handler.Queue, err)
+		d.Nack(false, true)
+		return
+	}
+	d.Ack(false)
+}
+
+// Функция публикации с ожиданием подтверждения брокера (канал должен быть в режиме confirm).
+// Без подтверждения сообщение может потеряться после записи в сокет, поэтому исходное
+// сообщение подтверждается только после того, как брокер принял опубликованную копию.
+
+func Publish_Confirmed(ctx context.Context, ch *amqp.Channel, exchange string, key string, msg amqp.Publishing) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(Getenv_Int("NOTIF_CONFIRM_TIMEOUT", 10))*time.Second)
+	defer cancel()
+
+	confirmation, err := ch.PublishWithDeferredConfirmWithContext(ctx, exchange, key, false, false, msg)
+	if err != nil {
+		return err
+	}
+	if confirmation == nil {
+		return errors.New("Channel is not in confirm mode")
+	}
+	acked, err := confirmation.WaitContext(ctx)
+	if err != nil {
+		return fmt.Errorf("Publish was not confirmed: %w", err)
+	}
+	if !acked {
+		return errors.New("Broker rejected the message")
+	}
+	return nil
+}
+
+// Функция генерации случайного идентификатора сообщения
+
+func newMessageID() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// Структура "мёртвого" сообщения для админки
+
+type DeadLetter struct {
+	Message_id  string                 `json:"message_id"`
+	Queue       string                 `json:"queue"`
+	Routing_key string                 `json:"routing_key"`
+	Reason      string                 `json:"reason"`
+	Failed_at   string                 `json:"failed_at"`
+	Headers     map[string]interface{} `json:"headers"`
+	Body        string                 `json:"body"`
+}
+
+func toDeadLetter(d amqp.Delivery) DeadLetter {
+	letter := DeadLetter{
+		Message_id: d.MessageId,
+		Headers:    d.Headers,
+		Body:       string(d.Body),
+	}
+	letter.Queue, _ = d.Headers[headerOriginalQueue].(string)
+	letter.Routing_key, _ = d.Headers[headerOriginalRoutingKey].(string)
+	letter.Reason, _ = d.Headers[headerFailureReason].(string)
+	letter.Failed_at, _ = d.Headers[headerFailedAt].(string)
+	return letter
+}
+
+// Функция обхода очереди "мёртвых" сообщений. Для каждого сообщения вызывается visit,
+// если он возвращает true, сообщение удаляется из очереди, иначе возвращается обратно.
+
+func walkDeadLetters(ch *amqp.Channel, limit int, visit func(d amqp.Delivery) (bool, error)) error {
+	// сообщения, которые нужно вернуть, держим неподтверждёнными до конца обхода,
+	// иначе Get снова выдаст их же
+	var keep []amqp.Delivery
+	defer func() {
+		for _, d := range keep {
+			d.Nack(false, true)
+		}
+	}()
+
+	for i := 0; i < limit; i++ {
+		d, ok, err := ch.Get(deadLetterQueue, false)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+		remove, err := visit(d)
+		if err != nil {
+			keep = append(keep, d)
+			return err
+		}
+		if remove {
+			d.Ack(false)
+		} else {
+			keep = append(keep, d)
+		}
+	}
+	return nil
+}
+
+// Функция проверки токена администратора из заголовка X-Admin-Token
+
+func Authorize_Admin(r *http.Request) bool {
+	token := os.Getenv("NOTIF_ADMIN_TOKEN")
+	return token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Admin-Token")), []byte(token)) == 1
+}
+
+// Регистрируем эндпоинты администрирования "мёртвых" сообщений
+
+func init() {
+	Register_Routes(Dead_Letter_Handlers)
+}
+
+// Функция регистрации эндпоинтов администрирования "мёртвых" сообщений:
+// список и просмотр, повторная отправка в исходный exchange и удаление.
+// Конкретное сообщение выбирается параметром message_id, без него действие применяется ко всем.
+
+func Dead_Letter_Handlers(router *Router, db *sql.DB) {
+	router.Mount_Func("/api/admin/dead_letters", func(w http.ResponseWriter, r *http.Request) {
+		if !Authorize_Admin(r) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		limit := 100
+		if value := r.URL.Query().Get("limit"); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed <= 0 {
+				http.Error(w, "Invalid limit", http.StatusBadRequest)
+				return
+			}
+			limit = parsed
+		}
+		messageID := r.URL.Query().Get("message_id")
+		matches := func(d amqp.Delivery) bool {
+			return messageID == "" || d.MessageId == messageID
+		}
+
+		ch, err := broker.Channel()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		defer ch.Close()
+		//сообщение удаляется из очереди только после подтверждения повторной публикации
+		if err := ch.Confirm(false); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		letters := []DeadLetter{}
+
+		switch r.Method {
+
+		// Список или просмотр одного сообщения
+
+		case http.MethodGet:
+			err = walkDeadLetters(ch, limit, func(d amqp.Delivery) (bool, error) {
+				if matches(d) {
+					letters = append(letters, toDeadLetter(d))
+				}
+				return false, nil
+			})
+
+		// Повторная отправка в исходный exchange с исходным ключом маршрутизации
+
+		case http.MethodPost:
+			err = walkDeadLetters(ch, limit, func(d amqp.Delivery) (bool, error) {
+				if !matches(d) {
+					return false, nil
+				}
+				headers := copyHeaders(d.Headers)
+				for _, key := range []string{headerFailureReason, headerFailedAt, headerOriginalQueue, headerOriginalExchange, headerOriginalRoutingKey, headerRetryCount} {
+					delete(headers, key)
+				}
+				exchange, _ := d.Headers[headerOriginalExchange].(string)
+				routingKey, _ := d.Headers[headerOriginalRoutingKey].(string)
+				if err := Publish_Confirmed(r.Context(), ch, exchange, routingKey, republished(d, headers)); err != nil {
+					return false, err
+				}
+				letters = append(letters, toDeadLetter(d))
+				return true, nil
+			})
+
+		// Удаление
+
+		case http.MethodDelete:
+			if messageID == "" {
+				var purged int
+				purged, err = ch.QueuePurge(deadLetterQueue, false)
+				if err == nil {
+					w.Header().Set("Content-Type", "application/json")
+					json.NewEncoder(w).Encode(map[string]int{"purged": purged})
+					return
+				}
+				break
+			}
+			err = walkDeadLetters(ch, limit, func(d amqp.Delivery) (bool, error) {
+				if !matches(d) {
+					return false, nil
+				}
+				letters = append(letters, toDeadLetter(d))
+				return true, nil
+			})
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if messageID != "" && len(letters) == 0 {
+			http.Error(w, "Message not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(letters)
+	})
+}
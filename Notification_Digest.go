@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Периодичность сводок
+
+const (
+	DigestHourly = "hourly"
+	DigestDaily  = "daily"
+)
+
+// Target уведомления-сводки
+
+const DigestTarget = "digest"
+
+// Данные уведомления-сводки: сколько уведомлений target по проекту накопилось
+// и их Notification_id, по которым клиент открывает исходные уведомления
+
+type DigestData struct {
+	Target           string  `json:"target"`
+	Frequency        string  `json:"frequency"`
+	Project_id       uint    `json:"project_id"`
+	ProjectTitle     string  `json:"project_title"`
+	Count            int     `json:"count"`
+	Notification_ids []int64 `json:"notification_ids"`
+}
+
+// Условие выборки, исключающее уведомления, которые пользователь получает в сводке:
+// ещё ожидающие отправки и уже отправленные в сохранённой сводке. Такие уведомления
+// не попадают в список /api, счётчики непрочитанных и SSE, их можно открыть по сводке:
+// /api?digest=<Notification_id сводки>.
+
+const notDigested = "NOT EXISTS (SELECT 1 FROM digest_items WHERE digest_items.notification_id = notification_registration.id AND (digest_items.flushed_at IS NULL OR digest_items.digest_id IS NOT NULL))"
+
+// Функция получения периодичности сводки пользователя для target, пустая строка - сводка не включена
+
+func Digest_Frequency(q Querier, uuid string, target string) (string, error) {
+	var frequency string
+	err := q.QueryRow("SELECT frequency FROM digest_settings WHERE uuid=$1 AND target=$2", uuid, target).Scan(&frequency)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return frequency, err
+}
+
+// Функция периодической отправки накопившихся сводок
+
+func Run_Digests(ctx context.Context, db *sql.DB) {
+	ticker := time.NewTicker(time.Duration(Getenv_Int("NOTIF_DIGEST_INTERVAL", 60)) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := Flush_Digests(db); err != nil {
+				log.Printf("Failed to send digests: %v", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Функция формирования сводок. Часовая сводка включает уведомления, накопленные до начала
+// текущего часа, дневная - до начала текущих суток (в часовом поясе базы данных).
+// Уведомления группируются по получателю, target и проекту; на каждую группу
+// сохраняется одно уведомление с target "digest". Отправленные уведомления остаются
+// в digest_items со ссылкой на свою сводку. Если сводка не сохранена в списке
+// (in_app для digest выключен или сводка уже есть), уведомления удаляются из digest_items
+// и снова видны в списке.
+
+func Flush_Digests(db *sql.DB) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`WITH due AS (
+		UPDATE digest_items SET flushed_at = now()
+		WHERE flushed_at IS NULL
+			AND created_at < CASE frequency WHEN 'hourly' THEN date_trunc('hour', now()) ELSE date_trunc('day', now()) END
+		RETURNING notification_id, frequency
+	)
+	SELECT n.uuid, n.target, due.frequency,
+		COALESCE((n.notification::jsonb->>'project_id')::bigint, 0) AS project_id,
+		COALESCE(max(n.notification::jsonb->>'project_title'), ''),
+		array_agg(n.id ORDER BY n.id)
+	FROM due JOIN notification_registration n ON n.id = due.notification_id
+	GROUP BY n.uuid, n.target, due.frequency, project_id`)
+	if err != nil {
+		return err
+	}
+
+	type group struct {
+		uuid string
+		data DigestData
+	}
+	var groups []group
+	for rows.Next() {
+		var g group
+		var ids pq.Int64Array
+		if err := rows.Scan(&g.uuid, &g.data.Target, &g.data.Frequency, &g.data.Project_id, &g.data.ProjectTitle, &ids); err != nil {
+			rows.Close()
+			return err
+		}
+		g.data.Notification_ids = ids
+		g.data.Count = len(ids)
+		groups = append(groups, g)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	stored := make([]Stored_Notification, 0, len(groups))
+	for _, g := range groups {
+		body, err := json.Marshal(g.data)
+		if err != nil {
+			return err
+		}
+		preferences, err := Resolve_Preferences(tx, g.uuid, []string{DigestTarget})
+		if err != nil {
+			return err
+		}
+		channels := preferences[DigestTarget]
+
+		if !channels[ChannelInApp] {
+			if err := undigest(tx, g.data.Notification_ids); err != nil {
+				return err
+			}
+			stored = append(stored, Stored_Notification{
+				FromDB:   FromDB{UUID: g.uuid, Notification: string(body), Target: DigestTarget, Created_at: time.Now()},
+				Channels: channels,
+			})
+			continue
+		}
+
+		eventID := fmt.Sprintf("digest:%s:%d", g.data.Target, g.data.Notification_ids[0])
+		row := tx.QueryRow("INSERT INTO notification_registration (uuid, notification, target, event_id, event_time) VALUES ($1, $2, $3, $4, now()) ON CONFLICT (event_id, uuid) DO NOTHING RETURNING "+notificationColumns, g.uuid, string(body), DigestTarget, eventID)
+		registration, err := Scan_Notification(row)
+		if err == sql.ErrNoRows {
+			if err := undigest(tx, g.data.Notification_ids); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE digest_items SET digest_id=$1 WHERE notification_id = ANY($2)", registration.Notification_id, pq.Array(g.data.Notification_ids)); err != nil {
+			return err
+		}
+		stored = append(stored, Stored_Notification{FromDB: registration, Channels: channels})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for _, notification := range stored {
+		Deliver_Notification(db, notification)
+	}
+	return nil
+}
+
+// Функция возврата уведомлений в список, если они не попали ни в одну сохранённую сводку
+
+func undigest(tx *sql.Tx, ids []int64) error {
+	_, err := tx.Exec("DELETE FROM digest_items WHERE notification_id = ANY($1)", pq.Array(ids))
+	return err
+}
+
+// Регистрируем эндпоинт сводок пользователя
+
+func init() {
+	Register_Routes(Digest_Handlers)
+}
+
+// Функция регистрации эндпоинта сводок пользователя:
+// GET - периодичность по target, PUT {"target": "hourly" | "daily" | ""} - включение
+// или отключение (пустая строка), DELETE - отключение всех сводок.
+// Накопленные уведомления отключённой сводки всё равно придут в ближайшей сводке.
+
+func Digest_Handlers(router *Router, db *sql.DB) {
+	router.Mount_Authenticated("/api/preferences/digest", func(w http.ResponseWriter, r *http.Request) {
+		uuid := Principal_From(r.Context()).UUID
+
+		switch r.Method {
+		case http.MethodGet:
+
+		case http.MethodPut:
+			var request map[string]string
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				http.Error(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+			for target, frequency := range request {
+				if !Valid_Target(target) || target == DigestTarget {
+					http.Error(w, fmt.Sprintf("Unknown target %q", target), http.StatusBadRequest)
+					return
+				}
+				if frequency != "" && frequency != DigestHourly && frequency != DigestDaily {
+					http.Error(w, "frequency must be hourly, daily or empty", http.StatusBadRequest)
+					return
+				}
+			}
+
+			tx, err := db.Begin()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			defer tx.Rollback()
+			for target, frequency := range request {
+				if frequency == "" {
+					_, err = tx.Exec("DELETE FROM digest_settings WHERE uuid=$1 AND target=$2", uuid, target)
+				} else {
+					_, err = tx.Exec("INSERT INTO digest_settings (uuid, target, frequency) VALUES ($1, $2, $3) ON CONFLICT (uuid, target) DO UPDATE SET frequency=EXCLUDED.frequency, updated_at=now()", uuid, target, frequency)
+				}
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+			}
+			if err := tx.Commit(); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+		case http.MethodDelete:
+			if _, err := db.Exec("DELETE FROM digest_settings WHERE uuid=$1", uuid); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		rows, err := db.Query("SELECT target, frequency FROM digest_settings WHERE uuid=$1", uuid)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		settings := map[string]string{}
+		for rows.Next() {
+			var target, frequency string
+			if err := rows.Scan(&target, &frequency); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			settings[target] = frequency
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(settings)
+	})
+}
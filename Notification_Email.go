@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+// Структура письма
+
+type Email struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Интерфейс отправки писем, чтобы SMTP можно было заменить другим способом доставки
+
+type Sender interface {
+	Send(ctx context.Context, email Email) error
+}
+
+// Отправка писем через SMTP-сервер
+
+type SMTP_Sender struct {
+	Addr     string
+	From     string
+	Username string
+	Password string
+}
+
+// Функция создания SMTP-отправителя из окружения, если SMTP_ADDR не задан - возвращает nil
+
+func New_SMTP_Sender() Sender {
+	if os.Getenv("SMTP_ADDR") == "" {
+		return nil
+	}
+	return &SMTP_Sender{
+		Addr:     os.Getenv("SMTP_ADDR"),
+		From:     os.Getenv("SMTP_FROM"),
+		Username: os.Getenv("SMTP_USER"),
+		Password: os.Getenv("SMTP_PASS"),
+	}
+}
+
+// Функция формирования письма в формате RFC 5322 с телом в quoted-printable
+
+func (s *SMTP_Sender) message(email Email) ([]byte, error) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", s.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", email.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", email.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+
+	writer := quotedprintable.NewWriter(&buf)
+	if _, err := writer.Write([]byte(email.Body)); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (s *SMTP_Sender) Send(ctx context.Context, email Email) error {
+	if strings.ContainsAny(email.To, "\r\n") {
+		return fmt.Errorf("Invalid recipient %q", email.To)
+	}
+	message, err := s.message(email)
+	if err != nil {
+		return err
+	}
+
+	host, _, err := net.SplitHostPort(s.Addr)
+	if err != nil {
+		return err
+	}
+
+	// net/smtp не принимает context: соединение открываем сами, срок ctx переносим
+	// в deadline соединения, а при отмене ctx закрываем соединение
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", s.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	if err := s.send(conn, host, email.To, message); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return fmt.Errorf("SMTP server did not respond in time: %w", context.DeadlineExceeded)
+		}
+		return err
+	}
+	return nil
+}
+
+// Функция отправки письма по открытому соединению, повторяет smtp.SendMail
+
+func (s *SMTP_Sender) send(conn net.Conn, host string, to string, message []byte) error {
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if err := client.Hello("localhost"); err != nil {
+		return err
+	}
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if s.Username != "" {
+		if ok, _ := client.Extension("AUTH"); !ok {
+			return errors.New("SMTP server does not support AUTH")
+		}
+		if err := client.Auth(smtp.PlainAuth("", s.Username, s.Password, host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(s.From); err != nil {
+		return err
+	}
+	if err := client.Rcpt(to); err != nil {
+		return err
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write(message); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// Структура очереди писем: письма отправляются в отдельной горутине,
+// чтобы медленный SMTP-сервер не задерживал обработку сообщений из RabbitMQ
+
+type Mailer struct {
+	sender   Sender
+	queue    chan Email
+	delivery *Delivery_Queue
+}
+
+// Общая очередь писем
+
+var mailer = New_Mailer(New_SMTP_Sender())
+
+func New_Mailer(sender Sender) *Mailer {
+	return &Mailer{
+		sender:   sender,
+		queue:    make(chan Email, Getenv_Int("NOTIF_EMAIL_QUEUE", 100)),
+		delivery: New_Delivery_Queue("Email"),
+	}
+}
+
+// Функция постановки письма в очередь. Если отправка не настроена или очередь переполнена, письмо пропускается.
+
+func (m *Mailer) Enqueue(email Email) {
+	if m.sender == nil {
+		return
+	}
+	accepted := m.delivery.Accept(func() {
+		select {
+		case m.queue <- email:
+		default:
+			log.Printf("Email queue is full, email to %s dropped", email.To)
+		}
+	})
+	if !accepted {
+		log.Printf("Email queue is stopped, email to %s dropped", email.To)
+	}
+}
+
+// Функция остановки: новые письма не принимаются, письма из очереди отправляются до завершения ctx
+
+func (m *Mailer) Stop(ctx context.Context) error {
+	return m.delivery.Stop(ctx, func() { close(m.queue) }, func() int { return len(m.queue) })
+}
+
+// Количество попыток отправки письма
+
+const emailAttempts = 3
+
+// Функция отправки писем из очереди с несколькими попытками
+
+func (m *Mailer) Run() {
+	defer m.delivery.Finish()
+	if m.sender == nil {
+		log.Printf("SMTP_ADDR is not set, email channel disabled")
+		return
+	}
+	abort := m.delivery.Abort
+	for email := range m.queue {
+		for attempt := 0; attempt < emailAttempts && abort.Err() == nil; attempt++ {
+			ctx, cancel := context.WithTimeout(abort, 30*time.Second)
+			err := m.sender.Send(ctx, email)
+			cancel()
+			if err == nil {
+				break
+			}
+			log.Printf("Failed to send email to %s (attempt %d): %v", email.To, attempt+1, err)
+			if attempt == emailAttempts-1 {
+				break
+			}
+			select {
+			case <-time.After(Backoff(attempt)):
+			case <-abort.Done():
+			}
+		}
+	}
+}
+
+// Функция формирования и постановки в очередь письма о сохранённом уведомлении.
+// Адрес берётся из таблицы users, которая заполняется по событию регистрации.
+
+func Email_Notification(db *sql.DB, registration FromDB) {
+	if mailer.sender == nil {
+		return
+	}
+
+	var address string
+	err := db.QueryRow("SELECT email FROM users WHERE uuid=$1", registration.UUID).Scan(&address)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Failed to load email address for %s: %v", registration.UUID, err)
+		return
+	}
+	if address == "" {
+		log.Printf("No email address for %s, email for notification %d skipped", registration.UUID, registration.Notification_id)
+		return
+	}
+
+	// Письмо на языке, выбранном пользователем
+	locale, err := User_Locale(db, registration.UUID)
+	if err != nil {
+		log.Printf("Failed to load locale for %s: %v", registration.UUID, err)
+	}
+
+	notification, err := Build_Notification(registration, renderer.Resolve_Locale(locale))
+	if err != nil {
+		log.Printf("Failed to build email for notification %d: %v", registration.Notification_id, err)
+		return
+	}
+	mailer.Enqueue(Email{To: address, Subject: notification.Title, Body: notification.Body})
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"mime/quotedprintable"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Минимальный SMTP-сервер: принимает одно письмо и отдаёт команды и данные в канал
+
+type smtpSession struct {
+	Commands []string
+	Data     string
+}
+
+func newFakeSMTP(t *testing.T) (string, <-chan smtpSession) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	sessions := make(chan smtpSession, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+		reader := bufio.NewReader(conn)
+		reply := func(line string) { io.WriteString(conn, line+"\r\n") }
+		var session smtpSession
+
+		reply("220 localhost ESMTP")
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			command := strings.TrimRight(line, "\r\n")
+			session.Commands = append(session.Commands, command)
+
+			switch verb := strings.ToUpper(strings.SplitN(command, " ", 2)[0]); verb {
+			case "EHLO", "HELO":
+				reply("250 localhost")
+			case "MAIL", "RCPT", "RSET", "NOOP":
+				reply("250 OK")
+			case "DATA":
+				reply("354 End data with <CR><LF>.<CR><LF>")
+				var data strings.Builder
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if line == ".\r\n" {
+						break
+					}
+					data.WriteString(strings.TrimPrefix(line, "."))
+				}
+				session.Data = data.String()
+				reply("250 OK queued")
+			case "QUIT":
+				reply("221 Bye")
+				sessions <- session
+				return
+			default:
+				reply("502 Command not implemented")
+			}
+		}
+	}()
+	return listener.Addr().String(), sessions
+}
+
+func TestSMTPSenderSend(t *testing.T) {
+	addr, sessions := newFakeSMTP(t)
+	sender := &SMTP_Sender{Addr: addr, From: "notifications@example.com"}
+
+	email := Email{To: "user@example.com", Subject: "Новое согласование", Body: "Проект «Тест» ожидает согласования"}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := sender.Send(ctx, email); err != nil {
+		t.Fatalf("Send() error = %v", err)
+	}
+
+	session := <-sessions
+	commands := strings.Join(session.Commands, "\n")
+	for _, want := range []string{"MAIL FROM:<notifications@example.com>", "RCPT TO:<user@example.com>", "DATA", "QUIT"} {
+		if !strings.Contains(commands, want) {
+			t.Errorf("command %q was not sent, got:\n%s", want, commands)
+		}
+	}
+
+	header, body, ok := strings.Cut(session.Data, "\r\n\r\n")
+	if !ok {
+		t.Fatalf("message has no body:\n%s", session.Data)
+	}
+	for _, want := range []string{
+		"From: notifications@example.com",
+		"To: user@example.com",
+		"Subject: =?utf-8?q?",
+		"Content-Type: text/plain; charset=utf-8",
+		"Content-Transfer-Encoding: quoted-printable",
+	} {
+		if !strings.Contains(header, want) {
+			t.Errorf("header %q is missing:\n%s", want, header)
+		}
+	}
+	decoded, err := io.ReadAll(quotedprintable.NewReader(strings.NewReader(body)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimRight(string(decoded), "\r\n") != email.Body {
+		t.Errorf("body = %q, want %q", decoded, email.Body)
+	}
+}
+
+func TestSMTPSenderRejectsHeaderInjection(t *testing.T) {
+	sender := &SMTP_Sender{Addr: "127.0.0.1:1", From: "notifications@example.com"}
+	err := sender.Send(context.Background(), Email{To: "user@example.com\r\nBcc: victim@example.com", Subject: "s", Body: "b"})
+	if err == nil {
+		t.Fatal("Send() accepted a recipient with CRLF")
+	}
+}
+
+// SMTP-сервер, который принимает соединение, но не отвечает.
+// Канал закрывается, когда клиент закрывает соединение.
+
+func newSilentSMTP(t *testing.T) (string, <-chan struct{}) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	closed := make(chan struct{})
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(io.Discard, conn)
+		close(closed)
+	}()
+	return listener.Addr().String(), closed
+}
+
+func TestSMTPSenderTimeout(t *testing.T) {
+	tests := []struct {
+		name   string
+		cancel func() (context.Context, context.CancelFunc)
+		want   error
+	}{
+		{"deadline", func() (context.Context, context.CancelFunc) {
+			return context.WithTimeout(context.Background(), 100*time.Millisecond)
+		}, context.DeadlineExceeded},
+		{"cancel", func() (context.Context, context.CancelFunc) {
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(100*time.Millisecond, cancel)
+			return ctx, cancel
+		}, context.Canceled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, closed := newSilentSMTP(t)
+			sender := &SMTP_Sender{Addr: addr, From: "notifications@example.com"}
+			ctx, cancel := tt.cancel()
+			defer cancel()
+
+			err := sender.Send(ctx, Email{To: "user@example.com", Subject: "s", Body: "b"})
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("Send() error = %v, want %v", err, tt.want)
+			}
+			// соединение с зависшим сервером не должно оставаться открытым
+			select {
+			case <-closed:
+			case <-time.After(time.Second):
+				t.Fatal("Send() left the SMTP connection open")
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Структура группы уведомлений одного target по одному проекту.
+// Title и Body - свёрнутый текст группы, Latest - последнее уведомление группы.
+
+type NotificationGroup struct {
+	Title            string    `json:"title"`
+	Body             string    `json:"body"`
+	Target           string    `json:"target"`
+	Target_data      uint      `json:"target_data"`
+	Count            int       `json:"count"`
+	Unread           int       `json:"unread"`
+	Latest_at        time.Time `json:"latest_at"`
+	Notification_ids []int64   `json:"notification_ids"`
+	Latest           SendJson  `json:"latest"`
+}
+
+// Данные для шаблона group.tmpl
+
+type groupData struct {
+	Target       string
+	ProjectTitle string
+	Count        int
+	Unread       int
+	Latest       SendJson
+}
+
+// Функция построения запроса групп по фильтру. Группы упорядочены по последнему
+// уведомлению, курсор - Notification_id последнего уведомления последней группы страницы.
+
+func (filter ListFilter) Group_Query(uuid string) (string, []interface{}) {
+	conditions, args := filter.where(uuid)
+
+	order, cursorOperator := "DESC", "<"
+	if filter.Ascending {
+		order, cursorOperator = "ASC", ">"
+	}
+
+	having := ""
+	if filter.Cursor != 0 {
+		args = append(args, filter.Cursor)
+		having = fmt.Sprintf(" HAVING max(id)%s$%d", cursorOperator, len(args))
+	}
+
+	args = append(args, filter.Limit+1)
+	query := `WITH groups AS (
+		SELECT count(*) AS total, count(*) FILTER (WHERE NOT read) AS unread,
+			max(created_at) AS latest_at, array_agg(id ORDER BY id DESC) AS ids, max(id) AS latest_id
+		FROM notification_registration WHERE ` + strings.Join(conditions, " AND ") + `
+		GROUP BY target, COALESCE((notification::jsonb->>'project_id')::bigint, 0)` + having + fmt.Sprintf(`
+		ORDER BY latest_id %s LIMIT $%d
+	)
+	SELECT total, unread, latest_at, ids, %s
+	FROM groups JOIN notification_registration ON id = latest_id
+	ORDER BY latest_id %s`, order, len(args), notificationColumns, order)
+
+	return query, args
+}
+
+// Функция выдачи уведомлений, сгруппированных по проекту и target (/api?group=project)
+
+func Write_Groups(w http.ResponseWriter, db *sql.DB, filter ListFilter, uuid string, locale string) {
+	query, args := filter.Group_Query(uuid)
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	groups := []NotificationGroup{}
+	var lastID int64
+	for rows.Next() {
+		// Лишняя строка означает, что есть следующая страница
+		if len(groups) == filter.Limit {
+			w.Header().Set("X-Next-Cursor", strconv.FormatInt(lastID, 10))
+			break
+		}
+
+		var group NotificationGroup
+		var ids pq.Int64Array
+		var latest FromDB
+		err := rows.Scan(&group.Count, &group.Unread, &group.Latest_at, &ids,
+			&latest.Notification_id, &latest.UUID, &latest.Notification, &latest.Is_Read, &latest.Target, &latest.Created_at, &latest.Read_at, &latest.Event_time)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		lastID = latest.Notification_id
+
+		group.Latest, err = Build_Notification(latest, locale)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		group.Target = latest.Target
+		group.Target_data = group.Latest.Target_data
+		group.Notification_ids = ids
+
+		// Название проекта берём из последнего уведомления группы
+		var project struct {
+			ProjectTitle string `json:"project_title"`
+		}
+		json.Unmarshal([]byte(latest.Notification), &project)
+
+		group.Title, group.Body, err = renderer.Render(locale, "group", groupData{
+			Target:       group.Target,
+			ProjectTitle: project.ProjectTitle,
+			Count:        group.Count,
+			Unread:       group.Unread,
+			Latest:       group.Latest,
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		groups = append(groups, group)
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(groups)
+}
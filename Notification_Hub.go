@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Размер буфера уведомлений одной подписки
+
+const subscriberBuffer = 16
+
+// Структура хаба подписок: для каждого uuid хранится набор каналов
+// открытых сессий (вкладок) пользователя
+
+type Hub struct {
+	mu          sync.RWMutex
+	subscribers map[string]map[chan FromDB]struct{}
+	closed      bool
+}
+
+// Общий хаб, в который консьюмеры публикуют сохранённые уведомления
+
+var hub = New_Hub()
+
+func New_Hub() *Hub {
+	return &Hub{subscribers: make(map[string]map[chan FromDB]struct{})}
+}
+
+// Функция подписки сессии на уведомления пользователя.
+// Возвращает канал уведомлений и функцию отписки. Уведомления приходят записями
+// из базы данных, каждая сессия формирует текст на своём языке.
+// Канал закрывается при остановке сервиса, после этого сессия должна завершиться.
+
+func (h *Hub) Subscribe(uuid string) (<-chan FromDB, func()) {
+	ch := make(chan FromDB, subscriberBuffer)
+
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		close(ch)
+		return ch, func() {}
+	}
+	if h.subscribers[uuid] == nil {
+		h.subscribers[uuid] = make(map[chan FromDB]struct{})
+	}
+	h.subscribers[uuid][ch] = struct{}{}
+	h.mu.Unlock()
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			h.mu.Lock()
+			delete(h.subscribers[uuid], ch)
+			if len(h.subscribers[uuid]) == 0 {
+				delete(h.subscribers, uuid)
+			}
+			h.mu.Unlock()
+		})
+	}
+	return ch, unsubscribe
+}
+
+// Функция рассылки уведомления во все сессии пользователя.
+// Медленная сессия не блокирует остальных: если её буфер заполнен, уведомление для неё пропускается.
+
+func (h *Hub) Publish(uuid string, notification FromDB) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for ch := range h.subscribers[uuid] {
+		select {
+		case ch <- notification:
+		default:
+			log.Printf("Subscriber of %s is too slow, notification %d dropped", uuid, notification.Notification_id)
+		}
+	}
+}
+
+// Функция закрытия всех подписок при остановке сервиса
+
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return
+	}
+	h.closed = true
+	for _, channels := range h.subscribers {
+		for ch := range channels {
+			close(ch)
+		}
+	}
+	h.subscribers = make(map[string]map[chan FromDB]struct{})
+}
+
+// Exchange, через который сохранённые уведомления рассылаются всем экземплярам сервиса.
+// Консьюмеры разных экземпляров разбирают очереди событий между собой, а клиент
+// подключён по WebSocket или SSE только к одному из них.
+
+const fanoutExchange = "notification.fanout"
+
+// Функция объявления exchange рассылки уведомлений между экземплярами
+
+func Declare_Fanout(ch *amqp.Channel) error {
+	err := ch.ExchangeDeclare(
+		fanoutExchange, // name
+		"fanout",       // type
+		true,           // durable
+		false,          // auto-deleted
+		false,          // internal
+		false,          // no-wait
+		nil,            // arguments
+	)
+	if err != nil {
+		return fmt.Errorf("Failed to declare a fanout exchange: %w", err)
+	}
+	return nil
+}
+
+// Функция объявления очереди экземпляра и подписки на неё. Очередь эксклюзивная
+// и удаляется вместе с соединением, поэтому остановленный экземпляр не копит уведомления.
+
+func Declare_Fanout_Consumer(ch *amqp.Channel) (<-chan amqp.Delivery, error) {
+	if err := Declare_Fanout(ch); err != nil {
+		return nil, err
+	}
+
+	q, err := ch.QueueDeclare(
+		"",    // name, генерирует RabbitMQ
+		false, // durable
+		true,  // delete when unused
+		true,  // exclusive
+		false, // no-wait
+		nil,   // arguments
+	)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to declare a fanout queue: %w", err)
+	}
+
+	err = ch.QueueBind(q.Name, "", fanoutExchange, false, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to bind a fanout queue: %w", err)
+	}
+
+	//доставка подключённым клиентам не гарантируется, подтверждать вручную незачем
+	msgs, err := ch.Consume(
+		q.Name, // queue
+		"",     // consumer
+		true,   // auto-ack
+		true,   // exclusive
+		false,  // no-local
+		false,  // no-wait
+		nil,    // args
+	)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to register a fanout consumer: %w", err)
+	}
+	return msgs, nil
+}
+
+// Функция поддержания подписки экземпляра на рассылку уведомлений: полученные
+// уведомления публикуются в локальный хаб. После переподключения очередь объявляется заново,
+// уведомления, разосланные в это время, клиенты SSE досылают себе по Last-Event-ID.
+// Завершается по ctx.
+
+func Supervise_Fanout(ctx context.Context) {
+	for attempt := 0; ; {
+		if err := broker.Wait(ctx); err != nil {
+			return
+		}
+
+		ch, err := broker.Channel()
+		if err == nil {
+			var msgs <-chan amqp.Delivery
+			msgs, err = Declare_Fanout_Consumer(ch)
+			if err == nil {
+				attempt = 0
+				log.Printf("Fanout consumer started")
+				Fanout_Loop(ctx, msgs)
+				log.Printf("Fanout consumer stopped")
+			}
+			ch.Close()
+		}
+		if err != nil {
+			log.Printf("Failed to start fanout consumer: %v", err)
+		}
+
+		select {
+		case <-time.After(Backoff(attempt)):
+		case <-ctx.Done():
+			return
+		}
+		attempt++
+	}
+}
+
+// Функция публикации разосланных уведомлений в локальный хаб
+
+func Fanout_Loop(ctx context.Context, msgs <-chan amqp.Delivery) {
+	for {
+		select {
+		case d, ok := <-msgs:
+			if !ok {
+				return
+			}
+			var registration FromDB
+			if err := json.Unmarshal(d.Body, &registration); err != nil {
+				log.Printf("Failed to unmarshal broadcast notification: %v", err)
+				continue
+			}
+			hub.Publish(registration.UUID, registration)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Функция публикации только что сохранённого уведомления. Уведомление рассылается
+// всем экземплярам, и каждый отправляет его своим подключённым клиентам.
+// Если RabbitMQ недоступен, уведомление получат только клиенты этого экземпляра.
+
+func Publish_Notification(registration FromDB) {
+	body, err := json.Marshal(registration)
+	if err == nil {
+		err = broker.Publish(context.Background(), fanoutExchange, "", amqp.Publishing{
+			ContentType: "application/json",
+			Body:        body,
+		})
+	}
+	if err != nil {
+		log.Printf("Failed to broadcast notification %d, publishing locally: %v", registration.Notification_id, err)
+		hub.Publish(registration.UUID, registration)
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Ключ в формате JWK (RFC 7517), поддерживаются RSA и EC
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// Набор ключей в формате JWKS
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// Ключ проверки подписи и алгоритм, для которого он предназначен (пусто - любой подходящий)
+
+type Verification_Key struct {
+	Key interface{}
+	Alg string
+}
+
+// Структура набора ключей проверки подписи токенов. Ключи читаются из файла
+// или по URL, кешируются по kid и перечитываются, когда встречается неизвестный kid
+// (не чаще раза в JWT_JWKS_MIN_REFRESH секунд) или кеш старше JWT_JWKS_TTL секунд.
+
+type Key_Set struct {
+	url    string
+	file   string
+	client *http.Client
+
+	mu          sync.RWMutex
+	keys        map[string]Verification_Key
+	loadedAt    time.Time
+	refreshedAt time.Time
+
+	// одновременно выполняется только одно обновление
+	refresh sync.Mutex
+}
+
+// Общий набор ключей, nil - JWKS не настроен и проверяются только HMAC-токены
+
+var keySet = New_Key_Set(os.Getenv("JWT_JWKS_URL"), os.Getenv("JWT_JWKS_FILE"))
+
+// Функция создания набора ключей, если не задан ни URL, ни файл - возвращает nil.
+// Ключи загружаются при первой проверке токена, чтобы сервис запускался без сервиса авторизации.
+
+func New_Key_Set(url string, file string) *Key_Set {
+	if url == "" && file == "" {
+		return nil
+	}
+	return &Key_Set{
+		url:    url,
+		file:   file,
+		client: &http.Client{Timeout: 10 * time.Second},
+		keys:   make(map[string]Verification_Key),
+	}
+}
+
+// Функция чтения JWKS из файла или по URL
+
+func (s *Key_Set) fetch() ([]byte, error) {
+	if s.file != "" {
+		return os.ReadFile(s.file)
+	}
+	resp, err := s.client.Get(s.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("JWKS endpoint responded %d", resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+// Функция загрузки ключей. При ошибке прежние ключи остаются в кеше.
+
+func (s *Key_Set) Load() error {
+	s.mu.Lock()
+	s.refreshedAt = time.Now()
+	s.mu.Unlock()
+
+	data, err := s.fetch()
+	if err != nil {
+		return fmt.Errorf("Failed to load JWKS: %w", err)
+	}
+	var set JWKS
+	if err := json.Unmarshal(data, &set); err != nil {
+		return fmt.Errorf("Failed to parse JWKS: %w", err)
+	}
+
+	keys := make(map[string]Verification_Key, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.Public_Key()
+		if err != nil {
+			log.Printf("Skipping JWKS key %q: %v", jwk.Kid, err)
+			continue
+		}
+		keys[jwk.Kid] = Verification_Key{Key: key, Alg: jwk.Alg}
+	}
+
+	s.mu.Lock()
+	s.keys = keys
+	s.loadedAt = time.Now()
+	s.mu.Unlock()
+	log.Printf("Loaded %d JWKS keys", len(keys))
+	return nil
+}
+
+// Функция поиска ключа в кеше. Без kid подходит единственный ключ набора.
+
+func (s *Key_Set) lookup(kid string) (Verification_Key, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if kid == "" && len(s.keys) == 1 {
+		for _, key := range s.keys {
+			return key, true
+		}
+	}
+	key, ok := s.keys[kid]
+	return key, ok
+}
+
+// Функция проверки, нужно ли обновлять ключи: кеш устарел или встретился неизвестный kid (force),
+// и с прошлого обновления прошло не меньше JWT_JWKS_MIN_REFRESH секунд
+
+func (s *Key_Set) needsRefresh(force bool) bool {
+	s.mu.RLock()
+	sinceRefresh := time.Since(s.refreshedAt)
+	stale := time.Since(s.loadedAt) > time.Duration(Getenv_Int("JWT_JWKS_TTL", 3600))*time.Second
+	s.mu.RUnlock()
+
+	if !force && !stale {
+		return false
+	}
+	return sinceRefresh >= time.Duration(Getenv_Int("JWT_JWKS_MIN_REFRESH", 30))*time.Second
+}
+
+// Функция обновления ключей с ограничением частоты. Блокировка refresh берётся только
+// перед загрузкой, чтобы токены с известным kid проверялись, пока ключи загружаются.
+
+func (s *Key_Set) maybeRefresh(force bool) {
+	if !s.needsRefresh(force) {
+		return
+	}
+	s.refresh.Lock()
+	defer s.refresh.Unlock()
+
+	// ключи могли обновить, пока мы ждали блокировку
+	if !s.needsRefresh(force) {
+		return
+	}
+	if err := s.Load(); err != nil {
+		log.Print(err)
+	}
+}
+
+// Функция получения ключа по kid. Устаревший кеш обновляется, а неизвестный kid
+// означает, что сервис авторизации мог сменить ключи, и набор перечитывается.
+
+func (s *Key_Set) Key(kid string) (Verification_Key, error) {
+	s.maybeRefresh(false)
+	if key, ok := s.lookup(kid); ok {
+		return key, nil
+	}
+	s.maybeRefresh(true)
+	if key, ok := s.lookup(kid); ok {
+		return key, nil
+	}
+	return Verification_Key{}, fmt.Errorf("Unknown signing key %q", kid)
+}
+
+// Функция декодирования числа из base64url
+
+func decodeBigInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+// Функция получения открытого ключа из JWK
+
+func (jwk JWK) Public_Key() (interface{}, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid modulus: %w", err)
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil || !e.IsInt64() {
+			return nil, errors.New("Invalid exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("Unsupported curve %q", jwk.Crv)
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid x: %w", err)
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid y: %w", err)
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("Point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("Unsupported key type %q", jwk.Kty)
+}
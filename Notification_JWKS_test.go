@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/rsa"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Неизвестный kid означает смену ключей: набор перечитывается и новый ключ находится
+
+func TestKeySetRefreshesOnUnknownKid(t *testing.T) {
+	t.Setenv("JWT_JWKS_MIN_REFRESH", "0")
+
+	old, rotated := newRSAKey(t), newRSAKey(t)
+	stub := newJWKSStub(t, map[string]*rsa.PublicKey{"old": &old.PublicKey})
+	keys := New_Key_Set(stub.URL, "")
+
+	if _, err := keys.Key("old"); err != nil {
+		t.Fatalf("Key(old) error = %v", err)
+	}
+	if _, err := keys.Key("old"); err != nil {
+		t.Fatalf("Key(old) error = %v", err)
+	}
+	if stub.Requests() != 1 {
+		t.Fatalf("JWKS requested %d times, want 1: known kid must be served from cache", stub.Requests())
+	}
+
+	stub.Rotate(map[string]*rsa.PublicKey{"rotated": &rotated.PublicKey})
+	key, err := keys.Key("rotated")
+	if err != nil {
+		t.Fatalf("Key(rotated) error = %v", err)
+	}
+	if key.Key.(*rsa.PublicKey).N.Cmp(rotated.N) != 0 {
+		t.Fatal("Key(rotated) returned another key")
+	}
+	if stub.Requests() != 2 {
+		t.Fatalf("JWKS requested %d times, want 2", stub.Requests())
+	}
+}
+
+// Неизвестные kid не должны приводить к запросу JWKS на каждый токен
+
+func TestKeySetRefreshIsRateLimited(t *testing.T) {
+	t.Setenv("JWT_JWKS_MIN_REFRESH", "60")
+
+	key := newRSAKey(t)
+	stub := newJWKSStub(t, map[string]*rsa.PublicKey{"known": &key.PublicKey})
+	keys := New_Key_Set(stub.URL, "")
+
+	if _, err := keys.Key("known"); err != nil {
+		t.Fatalf("Key(known) error = %v", err)
+	}
+	for _, kid := range []string{"unknown-1", "unknown-2", "unknown-3"} {
+		_, err := keys.Key(kid)
+		if err == nil || !strings.Contains(err.Error(), "Unknown signing key") {
+			t.Fatalf("Key(%s) error = %v, want unknown signing key", kid, err)
+		}
+	}
+	if stub.Requests() != 1 {
+		t.Fatalf("JWKS requested %d times, want 1 within JWT_JWKS_MIN_REFRESH", stub.Requests())
+	}
+}
+
+// Устаревший кеш перечитывается, а при ошибке сервиса авторизации прежние ключи остаются
+
+func TestKeySetKeepsKeysWhenRefreshFails(t *testing.T) {
+	t.Setenv("JWT_JWKS_MIN_REFRESH", "0")
+	t.Setenv("JWT_JWKS_TTL", "0")
+
+	key := newRSAKey(t)
+	stub := newJWKSStub(t, map[string]*rsa.PublicKey{"known": &key.PublicKey})
+	keys := New_Key_Set(stub.URL, "")
+
+	if _, err := keys.Key("known"); err != nil {
+		t.Fatalf("Key(known) error = %v", err)
+	}
+	stub.Fail(true)
+	if _, err := keys.Key("known"); err != nil {
+		t.Fatalf("Key(known) error = %v after a failed refresh", err)
+	}
+	if stub.Requests() != 2 {
+		t.Fatalf("JWKS requested %d times, want 2: stale cache must be refreshed", stub.Requests())
+	}
+}
+
+func TestNewKeySetWithoutSource(t *testing.T) {
+	if keys := New_Key_Set("", ""); keys != nil {
+		t.Fatal("New_Key_Set() without URL and file must return nil")
+	}
+}
+
+// Пока ключи перечитываются из-за неизвестного kid, токены с известным kid проверяются без ожидания
+
+func TestKeySetKnownKidDoesNotWaitForRefresh(t *testing.T) {
+	t.Setenv("JWT_JWKS_MIN_REFRESH", "0")
+
+	key := newRSAKey(t)
+	stub := newJWKSStub(t, map[string]*rsa.PublicKey{"known": &key.PublicKey})
+	keys := New_Key_Set(stub.URL, "")
+	if _, err := keys.Key("known"); err != nil {
+		t.Fatalf("Key(known) error = %v", err)
+	}
+
+	release := stub.Hold()
+	defer release()
+	go keys.Key("unknown")
+	for stub.Requests() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := keys.Key("known")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Key(known) error = %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Key(known) waited for the JWKS refresh")
+	}
+}
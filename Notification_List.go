@@ -0,0 +1,278 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Допустимые значения поля target
+
+var Targets = []string{"negotiation", "responce", "status_changed", "fill_user", DigestTarget}
+
+// Поля сортировки /api: по умолчанию - порядок сохранения (id), created_at - время создания,
+// event_time - время исходного события, а если оно неизвестно - время создания
+
+var sortColumns = map[string]string{
+	"created_at": "created_at",
+	"event_time": "COALESCE(event_time, created_at)",
+}
+
+// Структура параметров выборки уведомлений для /api.
+// Курсор - Notification_id последнего уведомления предыдущей страницы, а при сортировке
+// по времени - ещё и его время (Cursor_time), по умолчанию уведомления отдаются
+// от новых к старым, order=asc - от старых к новым.
+// Group - уведомления группируются по проекту и target (group=project).
+// Digest - Notification_id сводки, выдаются вошедшие в неё уведомления (digest=<id>),
+// без него уведомления, отправленные в сводке, в список не попадают.
+
+type ListFilter struct {
+	Cursor         int64
+	Cursor_time    *time.Time
+	Limit          int
+	Sort           string
+	Ascending      bool
+	Targets        []string
+	Is_read        *bool
+	Created_after  *time.Time
+	Created_before *time.Time
+	Event_after    *time.Time
+	Event_before   *time.Time
+	Group          bool
+	Digest         int64
+}
+
+// Функция разбора query-параметров cursor, limit, sort, order, target, is_read,
+// created_after, created_before, event_after, event_before, group и digest
+
+func Parse_List_Filter(r *http.Request) (ListFilter, error) {
+	query := r.URL.Query()
+	filter := ListFilter{Limit: Getenv_Int("NOTIF_PAGE_SIZE", 50)}
+
+	if value := query.Get("sort"); value != "" && value != "id" {
+		if _, ok := sortColumns[value]; !ok {
+			return filter, errors.New("Invalid sort, expected id, created_at or event_time")
+		}
+		filter.Sort = value
+	}
+
+	// При сортировке по времени курсор имеет вид <время RFC3339>_<id>
+
+	if value := query.Get("cursor"); value != "" {
+		idValue := value
+		if filter.Sort != "" {
+			timeValue, rest, ok := strings.Cut(value, "_")
+			cursorTime, err := time.Parse(time.RFC3339Nano, timeValue)
+			if !ok || err != nil {
+				return filter, errors.New("Invalid cursor")
+			}
+			filter.Cursor_time = &cursorTime
+			idValue = rest
+		}
+		cursor, err := strconv.ParseInt(idValue, 10, 64)
+		if err != nil || cursor <= 0 {
+			return filter, errors.New("Invalid cursor")
+		}
+		filter.Cursor = cursor
+	}
+
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			return filter, errors.New("Invalid limit")
+		}
+		filter.Limit = limit
+	}
+	if maxLimit := Getenv_Int("NOTIF_PAGE_MAX", 200); filter.Limit > maxLimit {
+		filter.Limit = maxLimit
+	}
+
+	switch query.Get("order") {
+	case "", "desc":
+	case "asc":
+		filter.Ascending = true
+	default:
+		return filter, errors.New("Invalid order, expected asc or desc")
+	}
+
+	// target можно передать несколько раз или через запятую
+
+	for _, value := range query["target"] {
+		for _, target := range strings.Split(value, ",") {
+			if !Valid_Target(target) {
+				return filter, fmt.Errorf("Unknown target %q", target)
+			}
+			filter.Targets = append(filter.Targets, target)
+		}
+	}
+
+	if value := query.Get("is_read"); value != "" {
+		isRead, err := strconv.ParseBool(value)
+		if err != nil {
+			return filter, errors.New("Invalid is_read")
+		}
+		filter.Is_read = &isRead
+	}
+
+	if value := query.Get("created_after"); value != "" {
+		createdAfter, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return filter, errors.New("Invalid created_after, expected RFC3339")
+		}
+		filter.Created_after = &createdAfter
+	}
+
+	if value := query.Get("created_before"); value != "" {
+		createdBefore, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return filter, errors.New("Invalid created_before, expected RFC3339")
+		}
+		filter.Created_before = &createdBefore
+	}
+
+	if value := query.Get("event_after"); value != "" {
+		eventAfter, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return filter, errors.New("Invalid event_after, expected RFC3339")
+		}
+		filter.Event_after = &eventAfter
+	}
+
+	if value := query.Get("event_before"); value != "" {
+		eventBefore, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return filter, errors.New("Invalid event_before, expected RFC3339")
+		}
+		filter.Event_before = &eventBefore
+	}
+
+	switch query.Get("group") {
+	case "":
+	case "project":
+		filter.Group = true
+	default:
+		return filter, errors.New("Invalid group, expected project")
+	}
+	if value := query.Get("digest"); value != "" {
+		digest, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || digest <= 0 {
+			return filter, errors.New("Invalid digest")
+		}
+		filter.Digest = digest
+	}
+
+	if filter.Group && filter.Sort != "" {
+		return filter, errors.New("Groups are always sorted by the latest notification, sort is not supported")
+	}
+
+	return filter, nil
+}
+
+// Функция проверки значения target
+
+func Valid_Target(target string) bool {
+	for _, known := range Targets {
+		if target == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Функция построения условий выборки по фильтру, кроме курсора
+
+func (filter ListFilter) where(uuid string) ([]string, []interface{}) {
+	conditions := []string{"uuid=$1"}
+	args := []interface{}{uuid}
+
+	if filter.Digest != 0 {
+		args = append(args, filter.Digest)
+		conditions = append(conditions, fmt.Sprintf("id IN (SELECT notification_id FROM digest_items WHERE digest_id=$%d)", len(args)))
+	} else {
+		conditions = append(conditions, notDigested)
+	}
+
+	if len(filter.Targets) != 0 {
+		args = append(args, pq.Array(filter.Targets))
+		conditions = append(conditions, fmt.Sprintf("target = ANY($%d)", len(args)))
+	}
+	if filter.Is_read != nil {
+		args = append(args, *filter.Is_read)
+		conditions = append(conditions, fmt.Sprintf("read=$%d", len(args)))
+	}
+	if filter.Created_after != nil {
+		args = append(args, *filter.Created_after)
+		conditions = append(conditions, fmt.Sprintf("created_at>$%d", len(args)))
+	}
+	if filter.Created_before != nil {
+		args = append(args, *filter.Created_before)
+		conditions = append(conditions, fmt.Sprintf("created_at<$%d", len(args)))
+	}
+	if filter.Event_after != nil {
+		args = append(args, *filter.Event_after)
+		conditions = append(conditions, fmt.Sprintf("%s>$%d", sortColumns["event_time"], len(args)))
+	}
+	if filter.Event_before != nil {
+		args = append(args, *filter.Event_before)
+		conditions = append(conditions, fmt.Sprintf("%s<$%d", sortColumns["event_time"], len(args)))
+	}
+	return conditions, args
+}
+
+// Функция построения запроса к БД по фильтру.
+// Запрашивается Limit+1 строк, чтобы понять, есть ли следующая страница.
+
+func (filter ListFilter) Query(uuid string) (string, []interface{}) {
+	conditions, args := filter.where(uuid)
+
+	order, cursorOperator := "DESC", "<"
+	if filter.Ascending {
+		order, cursorOperator = "ASC", ">"
+	}
+
+	// при сортировке по времени id различает уведомления с одинаковым временем
+	orderBy := "id " + order
+	column, sorted := sortColumns[filter.Sort]
+	if sorted {
+		orderBy = column + " " + order + ", " + orderBy
+	}
+
+	if filter.Cursor != 0 {
+		if sorted {
+			args = append(args, *filter.Cursor_time, filter.Cursor)
+			conditions = append(conditions, fmt.Sprintf("(%s, id)%s($%d, $%d)", column, cursorOperator, len(args)-1, len(args)))
+		} else {
+			args = append(args, filter.Cursor)
+			conditions = append(conditions, fmt.Sprintf("id%s$%d", cursorOperator, len(args)))
+		}
+	}
+
+	args = append(args, filter.Limit+1)
+	query := "SELECT " + notificationColumns + " FROM notification_registration WHERE " +
+		strings.Join(conditions, " AND ") +
+		fmt.Sprintf(" ORDER BY %s LIMIT $%d", orderBy, len(args))
+
+	return query, args
+}
+
+// Функция формирования курсора следующей страницы по последнему уведомлению страницы
+
+func (filter ListFilter) Next_Cursor(last FromDB) string {
+	id := strconv.FormatInt(last.Notification_id, 10)
+	switch filter.Sort {
+	case "created_at":
+		return last.Created_at.UTC().Format(time.RFC3339Nano) + "_" + id
+	case "event_time":
+		eventTime := last.Created_at
+		if last.Event_time != nil {
+			eventTime = *last.Event_time
+		}
+		return eventTime.UTC().Format(time.RFC3339Nano) + "_" + id
+	}
+	return id
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SQL-файлы миграций вида NNNN_name.up.sql и NNNN_name.down.sql
+
+//go:embed Postgress/migrations/*.sql
+var migrationFiles embed.FS
+
+// Ключ advisory lock, чтобы несколько экземпляров сервиса не мигрировали одновременно
+
+const migrationLock = 730501
+
+// Структура одной миграции
+
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Функция чтения встроенных миграций, отсортированных по версии
+
+func Load_Migrations() ([]Migration, error) {
+	entries, err := migrationFiles.ReadDir("Postgress/migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int]*Migration)
+	for _, entry := range entries {
+		name := entry.Name()
+		var direction string
+		switch {
+		case strings.HasSuffix(name, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(name, ".down.sql"):
+			direction = "down"
+		default:
+			return nil, fmt.Errorf("Unexpected migration file %s", name)
+		}
+
+		prefix, rest, ok := strings.Cut(name, "_")
+		version, err := strconv.Atoi(prefix)
+		if !ok || err != nil {
+			return nil, fmt.Errorf("Invalid migration file name %s", name)
+		}
+
+		body, err := migrationFiles.ReadFile(path.Join("Postgress/migrations", name))
+		if err != nil {
+			return nil, err
+		}
+
+		migration := byVersion[version]
+		if migration == nil {
+			migration = &Migration{Version: version, Name: strings.TrimSuffix(rest, "."+direction+".sql")}
+			byVersion[version] = migration
+		}
+		if direction == "up" {
+			migration.Up = string(body)
+		} else {
+			migration.Down = string(body)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" {
+			return nil, fmt.Errorf("Migration %04d has no up file", migration.Version)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Функция выполнения действия с миграциями под advisory lock на отдельном соединении
+
+func withMigrationLock(db *sql.DB, action func(conn *sql.Conn) error) error {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLock); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", migrationLock)
+
+	_, err = conn.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER PRIMARY KEY, name TEXT NOT NULL, applied_at TIMESTAMPTZ NOT NULL DEFAULT now())")
+	if err != nil {
+		return err
+	}
+	return action(conn)
+}
+
+// Функция получения текущей версии схемы, 0 - миграции не применялись
+
+func schemaVersion(ctx context.Context, conn *sql.Conn) (int, error) {
+	var version int
+	err := conn.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	return version, err
+}
+
+// Функция применения миграции в транзакции вместе с записью о версии
+
+func applyMigration(ctx context.Context, conn *sql.Conn, statement string, record string, args ...interface{}) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, statement); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Функция применения всех ещё не применённых миграций
+
+func Migrate_Up(db *sql.DB) error {
+	migrations, err := Load_Migrations()
+	if err != nil {
+		return err
+	}
+
+	return withMigrationLock(db, func(conn *sql.Conn) error {
+		ctx := context.Background()
+		current, err := schemaVersion(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, migration := range migrations {
+			if migration.Version <= current {
+				continue
+			}
+			err := applyMigration(ctx, conn, migration.Up, "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", migration.Version, migration.Name)
+			if err != nil {
+				return fmt.Errorf("Migration %04d_%s failed: %w", migration.Version, migration.Name, err)
+			}
+			log.Printf("Applied migration %04d_%s", migration.Version, migration.Name)
+		}
+		return nil
+	})
+}
+
+// Функция отката steps последних применённых миграций
+
+func Migrate_Down(db *sql.DB, steps int) error {
+	migrations, err := Load_Migrations()
+	if err != nil {
+		return err
+	}
+
+	return withMigrationLock(db, func(conn *sql.Conn) error {
+		ctx := context.Background()
+		current, err := schemaVersion(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for i := len(migrations) - 1; i >= 0 && steps > 0; i-- {
+			migration := migrations[i]
+			if migration.Version > current {
+				continue
+			}
+			if migration.Down == "" {
+				return fmt.Errorf("Migration %04d_%s has no down file", migration.Version, migration.Name)
+			}
+			err := applyMigration(ctx, conn, migration.Down, "DELETE FROM schema_migrations WHERE version=$1", migration.Version)
+			if err != nil {
+				return fmt.Errorf("Rollback of %04d_%s failed: %w", migration.Version, migration.Name, err)
+			}
+			log.Printf("Rolled back migration %04d_%s", migration.Version, migration.Name)
+			steps--
+		}
+		return nil
+	})
+}
+
+// Функция получения текущей версии схемы
+
+func Migrate_Version(db *sql.DB) (int, error) {
+	var version int
+	err := withMigrationLock(db, func(conn *sql.Conn) error {
+		var err error
+		version, err = schemaVersion(context.Background(), conn)
+		return err
+	})
+	return version, err
+}
+
+// Функция обработки подкоманды: migrate up | migrate down [steps] | migrate version
+
+func Migrate_Command(db *sql.DB, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("Usage: migrate up | down [steps] | version")
+	}
+
+	switch args[0] {
+	case "up":
+		return Migrate_Up(db)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			parsed, err := strconv.Atoi(args[1])
+			if err != nil || parsed <= 0 {
+				return fmt.Errorf("Invalid number of steps %q", args[1])
+			}
+			steps = parsed
+		}
+		return Migrate_Down(db, steps)
+	case "version":
+		version, err := Migrate_Version(db)
+		if err != nil {
+			return err
+		}
+		fmt.Println(version)
+		return nil
+	}
+	return fmt.Errorf("Unknown migrate command %q", args[0])
+}
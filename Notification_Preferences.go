@@ -0,0 +1,287 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+)
+
+// Каналы доставки уведомлений
+
+const (
+	ChannelInApp   = "in_app"
+	ChannelEmail   = "email"
+	ChannelPush    = "push"
+	ChannelWebhook = "webhook"
+)
+
+var DeliveryChannels = []string{ChannelInApp, ChannelEmail, ChannelPush, ChannelWebhook}
+
+// Настройки доставки: target -> канал -> включён ли канал
+
+type Preferences map[string]map[string]bool
+
+// Значения по умолчанию для ролей: роль -> target -> канал -> включён ли канал.
+// Вместо роли и target можно указать "*", тогда значение действует для всех.
+// Пример файла NOTIF_PREFERENCES_FILE:
+//
+//	{"*": {"*": {"in_app": true, "email": false}}, "customer": {"responce": {"email": true}}}
+
+var roleDefaults = Load_Role_Defaults()
+
+// Функция чтения значений по умолчанию из файла NOTIF_PREFERENCES_FILE
+
+func Load_Role_Defaults() map[string]Preferences {
+	defaults := map[string]Preferences{}
+	file := os.Getenv("NOTIF_PREFERENCES_FILE")
+	if file == "" {
+		return defaults
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		log.Fatalf("Failed to read preference defaults: %v", err)
+	}
+	if err := json.Unmarshal(data, &defaults); err != nil {
+		log.Fatalf("Failed to parse preference defaults: %v", err)
+	}
+	return defaults
+}
+
+// Функция получения значения по умолчанию для роли: сначала точное совпадение роли и target,
+// затем "*" для target и для роли. Если ничего не задано, канал включён.
+
+func Default_Preference(role string, target string, channel string) bool {
+	for _, r := range []string{role, "*"} {
+		for _, t := range []string{target, "*"} {
+			if enabled, ok := roleDefaults[r][t][channel]; ok {
+				return enabled
+			}
+		}
+	}
+	return true
+}
+
+// Общий интерфейс *sql.DB и *sql.Tx для чтения настроек
+
+type Querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Функция получения итоговых настроек пользователя для target: сохранённые
+// значения пользователя поверх значений по умолчанию для его роли
+
+func Resolve_Preferences(q Querier, uuid string, targets []string) (Preferences, error) {
+	var role string
+	err := q.QueryRow("SELECT role FROM users WHERE uuid=$1", uuid).Scan(&role)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	preferences := make(Preferences, len(targets))
+	for _, target := range targets {
+		preferences[target] = make(map[string]bool, len(DeliveryChannels))
+		for _, channel := range DeliveryChannels {
+			if Supports_Channel(target, channel) {
+				preferences[target][channel] = Default_Preference(role, target, channel)
+			}
+		}
+	}
+
+	rows, err := q.Query("SELECT target, channel, enabled FROM notification_preferences WHERE uuid=$1", uuid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var target, channel string
+		var enabled bool
+		if err := rows.Scan(&target, &channel, &enabled); err != nil {
+			return nil, err
+		}
+		if preferences[target] != nil && Supports_Channel(target, channel) {
+			preferences[target][channel] = enabled
+		}
+	}
+	return preferences, rows.Err()
+}
+
+// Функция проверки, что в запросе только известные target и каналы
+
+func validatePreferences(preferences Preferences) error {
+	for target, channels := range preferences {
+		if !Valid_Target(target) {
+			return fmt.Errorf("Unknown target %q", target)
+		}
+		for channel := range channels {
+			if !Valid_Channel(channel) {
+				return fmt.Errorf("Unknown channel %q", channel)
+			}
+			if !Supports_Channel(target, channel) {
+				return fmt.Errorf("Channel %q is not available for target %q", channel, target)
+			}
+		}
+	}
+	return nil
+}
+
+// Функция проверки значения канала
+
+func Valid_Channel(channel string) bool {
+	for _, known := range DeliveryChannels {
+		if channel == known {
+			return true
+		}
+	}
+	return false
+}
+
+// Функция проверки, может ли уведомление target быть отправлено по каналу: письма
+// отправляются только по target, у обработчика которых включён Email, и для сводок
+
+func Supports_Channel(target string, channel string) bool {
+	if channel != ChannelEmail || target == DigestTarget {
+		return true
+	}
+	for _, handler := range handlers {
+		if handler.Target == target {
+			return handler.Email
+		}
+	}
+	return false
+}
+
+// Функция отправки итоговых настроек пользователя
+
+func writePreferences(w http.ResponseWriter, db *sql.DB, uuid string) {
+	preferences, err := Resolve_Preferences(db, uuid, Targets)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(preferences)
+}
+
+// Регистрируем эндпоинты настроек уведомлений пользователя
+
+func init() {
+	Register_Routes(Preferences_Handlers)
+}
+
+// Функция регистрации эндпоинта настроек уведомлений пользователя:
+// GET - итоговые настройки, PUT - изменение переданных значений
+// в формате {"target": {"channel": true}}, DELETE - сброс к значениям по умолчанию
+// (всех или только ?target=...&channel=...)
+
+func Preferences_Handlers(router *Router, db *sql.DB) {
+	router.Mount_Authenticated("/api/preferences", func(w http.ResponseWriter, r *http.Request) {
+		uuid := Principal_From(r.Context()).UUID
+
+		switch r.Method {
+		case http.MethodGet:
+
+		case http.MethodPut:
+			var preferences Preferences
+			if err := json.NewDecoder(r.Body).Decode(&preferences); err != nil {
+				http.Error(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+			if err := validatePreferences(preferences); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			tx, err := db.Begin()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			defer tx.Rollback()
+			for target, channels := range preferences {
+				for channel, enabled := range channels {
+					_, err := tx.Exec("INSERT INTO notification_preferences (uuid, target, channel, enabled) VALUES ($1, $2, $3, $4) ON CONFLICT (uuid, target, channel) DO UPDATE SET enabled=EXCLUDED.enabled, updated_at=now()", uuid, target, channel, enabled)
+					if err != nil {
+						http.Error(w, err.Error(), http.StatusInternalServerError)
+						return
+					}
+				}
+			}
+			if err := tx.Commit(); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+		case http.MethodDelete:
+			target, channel := r.URL.Query().Get("target"), r.URL.Query().Get("channel")
+			if (target != "" && !Valid_Target(target)) || (channel != "" && !Valid_Channel(channel)) {
+				http.Error(w, "Unknown target or channel", http.StatusBadRequest)
+				return
+			}
+			_, err := db.Exec("DELETE FROM notification_preferences WHERE uuid=$1 AND ($2='' OR target=$2) AND ($3='' OR channel=$3)", uuid, target, channel)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		writePreferences(w, db, uuid)
+	})
+
+	// Язык уведомлений пользователя: GET - выбранный язык, PUT {"locale": "en"} - выбор,
+	// DELETE - сброс, после чего язык берётся из Accept-Language
+
+	router.Mount_Authenticated("/api/preferences/locale", func(w http.ResponseWriter, r *http.Request) {
+		uuid := Principal_From(r.Context()).UUID
+
+		switch r.Method {
+		case http.MethodGet:
+
+		case http.MethodPut:
+			var request struct {
+				Locale string `json:"locale"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				http.Error(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+			locale := Normalize_Locale(request.Locale)
+			if !renderer.Has_Locale(locale) {
+				http.Error(w, "Unsupported locale", http.StatusBadRequest)
+				return
+			}
+			_, err := db.Exec("INSERT INTO user_locales (uuid, locale) VALUES ($1, $2) ON CONFLICT (uuid) DO UPDATE SET locale=EXCLUDED.locale, updated_at=now()", uuid, locale)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+		case http.MethodDelete:
+			if _, err := db.Exec("DELETE FROM user_locales WHERE uuid=$1", uuid); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		locale, err := User_Locale(db, uuid)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{"locale": locale})
+	})
+}
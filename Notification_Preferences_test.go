@@ -0,0 +1,61 @@
+package main
+
+import (
+	"database/sql/driver"
+	"strings"
+	"testing"
+)
+
+// Канал email есть только у target, по которым отправляются письма
+
+func TestResolvePreferencesOmitsUnsupportedEmail(t *testing.T) {
+	db, _ := newFakeDB(t, func(query string, args []driver.Value) ([]string, [][]driver.Value) {
+		if strings.Contains(query, "FROM users") {
+			return []string{"role"}, [][]driver.Value{{"student"}}
+		}
+		// сохранённое ранее значение для канала, которого у target нет, игнорируется
+		return []string{"target", "channel", "enabled"}, [][]driver.Value{
+			{"status_changed", ChannelEmail, true},
+			{"negotiation", ChannelEmail, false},
+		}
+	})
+
+	preferences, err := Resolve_Preferences(db, "3f1c2a9e-5b7d-4e8f-9a0b-1c2d3e4f5a6b", Targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := preferences["status_changed"][ChannelEmail]; ok {
+		t.Errorf("status_changed has an email channel: %v", preferences["status_changed"])
+	}
+	if !preferences["status_changed"][ChannelInApp] {
+		t.Errorf("status_changed in_app is disabled: %v", preferences["status_changed"])
+	}
+	if enabled, ok := preferences["negotiation"][ChannelEmail]; !ok || enabled {
+		t.Errorf("negotiation email = %v, %v, want saved false", enabled, ok)
+	}
+	if !preferences[DigestTarget][ChannelEmail] {
+		t.Errorf("digest email is not available: %v", preferences[DigestTarget])
+	}
+}
+
+func TestValidatePreferences(t *testing.T) {
+	tests := []struct {
+		name        string
+		preferences Preferences
+		ok          bool
+	}{
+		{"email for negotiation", Preferences{"negotiation": {ChannelEmail: true}}, true},
+		{"email for digest", Preferences{DigestTarget: {ChannelEmail: false}}, true},
+		{"push for status_changed", Preferences{"status_changed": {ChannelPush: false}}, true},
+		{"email for status_changed", Preferences{"status_changed": {ChannelEmail: true}}, false},
+		{"unknown target", Preferences{"unknown": {ChannelInApp: true}}, false},
+		{"unknown channel", Preferences{"negotiation": {"sms": true}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validatePreferences(tt.preferences); (err == nil) != tt.ok {
+				t.Fatalf("validatePreferences() error = %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Платформы устройств
+
+const (
+	PlatformFCM  = "fcm"
+	PlatformAPNs = "apns"
+)
+
+// Ошибка провайдера о том, что токен устройства больше не действителен
+
+var ErrInvalidToken = errors.New("Invalid device token")
+
+// Структура push-уведомления, формируется из SendJson
+
+type Push_Message struct {
+	Title           string
+	Body            string
+	Target          string
+	Target_data     uint
+	Notification_id int64
+}
+
+// Интерфейс провайдера push-уведомлений
+
+type Push_Provider interface {
+	Send(ctx context.Context, token string, message Push_Message) error
+}
+
+// Функция чтения тела ответа провайдера для текста ошибки
+
+func responseError(provider string, resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return fmt.Errorf("%s responded %d: %s", provider, resp.StatusCode, strings.TrimSpace(string(body)))
+}
+
+// Отправка через FCM HTTP v1 API
+
+type FCM_Provider struct {
+	Endpoint  string
+	ProjectID string
+	// Функция получения OAuth2-токена доступа
+	AccessToken func() (string, error)
+	Client      *http.Client
+}
+
+// Функция создания FCM-провайдера из окружения, если FCM_PROJECT_ID не задан - возвращает nil.
+// Токен доступа берётся из FCM_ACCESS_TOKEN или перечитывается из файла FCM_ACCESS_TOKEN_FILE,
+// который обновляет внешний процесс.
+
+func New_FCM_Provider() Push_Provider {
+	if os.Getenv("FCM_PROJECT_ID") == "" {
+		return nil
+	}
+	return &FCM_Provider{
+		Endpoint:  Getenv_Default("FCM_ENDPOINT", "https://fcm.googleapis.com"),
+		ProjectID: os.Getenv("FCM_PROJECT_ID"),
+		AccessToken: func() (string, error) {
+			if file := os.Getenv("FCM_ACCESS_TOKEN_FILE"); file != "" {
+				token, err := os.ReadFile(file)
+				return strings.TrimSpace(string(token)), err
+			}
+			return os.Getenv("FCM_ACCESS_TOKEN"), nil
+		},
+		Client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (p *FCM_Provider) Send(ctx context.Context, token string, message Push_Message) error {
+	payload := map[string]interface{}{
+		"message": map[string]interface{}{
+			"token": token,
+			"notification": map[string]string{
+				"title": message.Title,
+				"body":  message.Body,
+			},
+			// в data FCM принимает только строки
+			"data": map[string]string{
+				"target":          message.Target,
+				"target_data":     strconv.FormatUint(uint64(message.Target_data), 10),
+				"notification_id": strconv.FormatInt(message.Notification_id, 10),
+			},
+		},
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	accessToken, err := p.AccessToken()
+	if err != nil {
+		return err
+	}
+
+	endpoint := strings.TrimSuffix(p.Endpoint, "/") + "/v1/projects/" + url.PathEscape(p.ProjectID) + "/messages:send"
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+
+	// Токен удалён с устройства или больше не зарегистрирован. INVALID_ARGUMENT FCM возвращает
+	// и для ошибок в самом сообщении, поэтому по нему токены не удаляются.
+	var fcmError struct {
+		Error struct {
+			Status  string `json:"status"`
+			Details []struct {
+				ErrorCode string `json:"errorCode"`
+			} `json:"details"`
+		} `json:"error"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if json.Unmarshal(data, &fcmError) == nil {
+		for _, detail := range fcmError.Error.Details {
+			if detail.ErrorCode == "UNREGISTERED" {
+				return ErrInvalidToken
+			}
+		}
+		if fcmError.Error.Status == "NOT_FOUND" {
+			return ErrInvalidToken
+		}
+	}
+	return fmt.Errorf("FCM responded %d: %s", resp.StatusCode, strings.TrimSpace(string(data)))
+}
+
+// Отправка через APNs HTTP/2 API с авторизацией по токену (.p8 ключ)
+
+type APNs_Provider struct {
+	Endpoint string
+	Topic    string
+	KeyID    string
+	TeamID   string
+	Key      interface{}
+	Client   *http.Client
+
+	mu        sync.Mutex
+	token     string
+	tokenTime time.Time
+}
+
+// Функция создания APNs-провайдера из окружения, если APNS_KEY_FILE не задан - возвращает nil
+
+func New_APNs_Provider() Push_Provider {
+	file := os.Getenv("APNS_KEY_FILE")
+	if file == "" {
+		return nil
+	}
+	pem, err := os.ReadFile(file)
+	if err != nil {
+		log.Fatalf("Failed to read APNs key: %v", err)
+	}
+	key, err := jwt.ParseECPrivateKeyFromPEM(pem)
+	if err != nil {
+		log.Fatalf("Failed to parse APNs key: %v", err)
+	}
+	return &APNs_Provider{
+		Endpoint: Getenv_Default("APNS_ENDPOINT", "https://api.push.apple.com"),
+		Topic:    os.Getenv("APNS_TOPIC"),
+		KeyID:    os.Getenv("APNS_KEY_ID"),
+		TeamID:   os.Getenv("APNS_TEAM_ID"),
+		Key:      key,
+		// для https клиент сам договаривается об HTTP/2
+		Client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Функция получения токена провайдера. Apple требует обновлять его не чаще раза в 20 минут
+// и не реже раза в час.
+
+func (p *APNs_Provider) providerToken() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.token != "" && time.Since(p.tokenTime) < 50*time.Minute {
+		return p.token, nil
+	}
+
+	now := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.RegisteredClaims{
+		Issuer:   p.TeamID,
+		IssuedAt: jwt.NewNumericDate(now),
+	})
+	token.Header["kid"] = p.KeyID
+	signed, err := token.SignedString(p.Key)
+	if err != nil {
+		return "", err
+	}
+	p.token, p.tokenTime = signed, now
+	return signed, nil
+}
+
+func (p *APNs_Provider) Send(ctx context.Context, token string, message Push_Message) error {
+	payload := map[string]interface{}{
+		"aps": map[string]interface{}{
+			"alert": map[string]string{
+				"title": message.Title,
+				"body":  message.Body,
+			},
+			"sound": "default",
+		},
+		"target":          message.Target,
+		"target_data":     message.Target_data,
+		"notification_id": message.Notification_id,
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	providerToken, err := p.providerToken()
+	if err != nil {
+		return err
+	}
+
+	endpoint := strings.TrimSuffix(p.Endpoint, "/") + "/3/device/" + url.PathEscape(token)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "bearer "+providerToken)
+	req.Header.Set("apns-topic", p.Topic)
+	req.Header.Set("apns-push-type", "alert")
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusGone:
+		return ErrInvalidToken
+	case http.StatusBadRequest:
+		var apnsError struct {
+			Reason string `json:"reason"`
+		}
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if json.Unmarshal(data, &apnsError) == nil && (apnsError.Reason == "BadDeviceToken" || apnsError.Reason == "DeviceTokenNotForTopic") {
+			return ErrInvalidToken
+		}
+		return fmt.Errorf("APNs responded %d: %s", resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	return responseError("APNs", resp)
+}
+
+// Структура очереди push-уведомлений, отправляются в отдельной горутине
+
+type Pusher struct {
+	providers map[string]Push_Provider
+	queue     chan FromDB
+	delivery  *Delivery_Queue
+}
+
+// Общая очередь push-уведомлений
+
+var pusher = New_Pusher(map[string]Push_Provider{
+	PlatformFCM:  New_FCM_Provider(),
+	PlatformAPNs: New_APNs_Provider(),
+})
+
+func New_Pusher(providers map[string]Push_Provider) *Pusher {
+	configured := make(map[string]Push_Provider)
+	for platform, provider := range providers {
+		if provider != nil {
+			configured[platform] = provider
+		}
+	}
+	return &Pusher{
+		providers: configured,
+		queue:     make(chan FromDB, Getenv_Int("NOTIF_PUSH_QUEUE", 100)),
+		delivery:  New_Delivery_Queue("Push"),
+	}
+}
+
+// Функция постановки уведомления в очередь. Если провайдеры не настроены или очередь переполнена, уведомление пропускается.
+
+func (p *Pusher) Enqueue(registration FromDB) {
+	if len(p.providers) == 0 {
+		return
+	}
+	accepted := p.delivery.Accept(func() {
+		select {
+		case p.queue <- registration:
+		default:
+			log.Printf("Push queue is full, notification %d for %s dropped", registration.Notification_id, registration.UUID)
+		}
+	})
+	if !accepted {
+		log.Printf("Push queue is stopped, notification %d for %s dropped", registration.Notification_id, registration.UUID)
+	}
+}
+
+// Функция остановки: новые уведомления не принимаются, уведомления из очереди отправляются до завершения ctx
+
+func (p *Pusher) Stop(ctx context.Context) error {
+	return p.delivery.Stop(ctx, func() { close(p.queue) }, func() int { return len(p.queue) })
+}
+
+// Функция отправки уведомлений из очереди на все устройства пользователя.
+// Токены, которые провайдер признал недействительными, удаляются.
+
+func (p *Pusher) Run(db *sql.DB) {
+	defer p.delivery.Finish()
+	if len(p.providers) == 0 {
+		log.Printf("No push providers configured, push channel disabled")
+		return
+	}
+	for registration := range p.queue {
+		if p.delivery.Abort.Err() != nil {
+			continue
+		}
+		p.send(db, registration)
+	}
+}
+
+func (p *Pusher) send(db *sql.DB, registration FromDB) {
+	locale, err := User_Locale(db, registration.UUID)
+	if err != nil {
+		log.Printf("Failed to load locale for %s: %v", registration.UUID, err)
+	}
+	notification, err := Build_Notification(registration, renderer.Resolve_Locale(locale))
+	if err != nil {
+		log.Printf("Failed to build push for notification %d: %v", registration.Notification_id, err)
+		return
+	}
+	message := Push_Message{
+		Title:           notification.Title,
+		Body:            notification.Body,
+		Target:          notification.Target,
+		Target_data:     notification.Target_data,
+		Notification_id: notification.Notification_id,
+	}
+
+	rows, err := db.Query("SELECT token, platform FROM device_tokens WHERE uuid=$1", registration.UUID)
+	if err != nil {
+		log.Printf("Failed to load device tokens for %s: %v", registration.UUID, err)
+		return
+	}
+	type device struct{ token, platform string }
+	var devices []device
+	for rows.Next() {
+		var d device
+		if err := rows.Scan(&d.token, &d.platform); err != nil {
+			log.Printf("Failed to scan device token for %s: %v", registration.UUID, err)
+			break
+		}
+		devices = append(devices, d)
+	}
+	rows.Close()
+
+	for _, d := range devices {
+		provider := p.providers[d.platform]
+		if provider == nil {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(p.delivery.Abort, 15*time.Second)
+		err := provider.Send(ctx, d.token, message)
+		cancel()
+		if p.delivery.Abort.Err() != nil {
+			return
+		}
+
+		if errors.Is(err, ErrInvalidToken) {
+			log.Printf("Device token of %s rejected by %s, removing", registration.UUID, d.platform)
+			if _, err := db.Exec("DELETE FROM device_tokens WHERE token=$1", d.token); err != nil {
+				log.Printf("Failed to remove device token: %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			log.Printf("Failed to send push to %s via %s: %v", registration.UUID, d.platform, err)
+		}
+	}
+}
+
+// Структура запроса регистрации устройства
+
+type DeviceRequest struct {
+	Token    string `json:"token"`
+	Platform string `json:"platform"`
+}
+
+// Регистрируем эндпоинт устройств пользователя
+
+func init() {
+	Register_Routes(Device_Handlers)
+}
+
+// Функция регистрации эндпоинта устройств пользователя:
+// POST {"token": "...", "platform": "fcm" | "apns"} - регистрация,
+// DELETE {"token": "..."} - удаление
+
+func Device_Handlers(router *Router, db *sql.DB) {
+	router.Mount_Authenticated("/api/devices", func(w http.ResponseWriter, r *http.Request) {
+		uuid := Principal_From(r.Context()).UUID
+
+		if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var request DeviceRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Token == "" {
+			http.Error(w, "token is required", http.StatusBadRequest)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodPost:
+			if request.Platform != PlatformFCM && request.Platform != PlatformAPNs {
+				http.Error(w, "platform must be fcm or apns", http.StatusBadRequest)
+				return
+			}
+			// токен мог принадлежать другому пользователю на том же устройстве
+			_, err := db.Exec("INSERT INTO device_tokens (token, uuid, platform) VALUES ($1, $2, $3) ON CONFLICT (token) DO UPDATE SET uuid=EXCLUDED.uuid, platform=EXCLUDED.platform, updated_at=now()", request.Token, uuid, request.Platform)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+
+		case http.MethodDelete:
+			result, err := db.Exec("DELETE FROM device_tokens WHERE token=$1 AND uuid=$2", request.Token, uuid)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if deleted, err := result.RowsAffected(); err == nil && deleted == 0 {
+				http.Error(w, "Device not found", http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Тестовая база данных: на запросы отвечает функция rows, выполненные Exec запоминаются
+
+type fakeDB struct {
+	mu    sync.Mutex
+	rows  func(query string, args []driver.Value) ([]string, [][]driver.Value)
+	execs []string
+}
+
+var fakeDrivers int32
+
+func newFakeDB(t *testing.T, rows func(query string, args []driver.Value) ([]string, [][]driver.Value)) (*sql.DB, *fakeDB) {
+	t.Helper()
+	fake := &fakeDB{rows: rows}
+	name := fmt.Sprintf("fake-%d", atomic.AddInt32(&fakeDrivers, 1))
+	sql.Register(name, fake)
+	db, err := sql.Open(name, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, fake
+}
+
+func (fake *fakeDB) Execs() []string {
+	fake.mu.Lock()
+	defer fake.mu.Unlock()
+	return append([]string(nil), fake.execs...)
+}
+
+func (fake *fakeDB) Open(string) (driver.Conn, error) { return fakeConn{fake}, nil }
+
+type fakeConn struct{ db *fakeDB }
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) { return fakeStmt{c.db, query}, nil }
+func (c fakeConn) Close() error                              { return nil }
+func (c fakeConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("Transactions are not supported")
+}
+
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+}
+
+func (s fakeStmt) Close() error  { return nil }
+func (s fakeStmt) NumInput() int { return -1 }
+
+func (s fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+	s.db.execs = append(s.db.execs, fmt.Sprint(s.query, " ", args))
+	return driver.RowsAffected(1), nil
+}
+
+func (s fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	columns, values := s.db.rows(s.query, args)
+	return &fakeRows{columns: columns, values: values}, nil
+}
+
+type fakeRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
+// Тестовый FCM: для токенов из failures отвечает ошибкой с указанным статусом и кодом
+
+func newFCMStub(t *testing.T, failures map[string][2]string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/projects/test-project/messages:send" {
+			t.Errorf("unexpected FCM path %s", r.URL.Path)
+		}
+		if r.Header.Get("Authorization") != "Bearer access-token" {
+			t.Errorf("unexpected FCM authorization %q", r.Header.Get("Authorization"))
+		}
+		var request struct {
+			Message struct {
+				Token        string            `json:"token"`
+				Notification map[string]string `json:"notification"`
+				Data         map[string]string `json:"data"`
+			} `json:"message"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("invalid FCM request: %v", err)
+		}
+		if request.Message.Data["notification_id"] != "42" {
+			t.Errorf("unexpected FCM data %v", request.Message.Data)
+		}
+		if failure, ok := failures[request.Message.Token]; ok {
+			status, code := failure[0], failure[1]
+			httpStatus := http.StatusBadRequest
+			if status == "NOT_FOUND" {
+				httpStatus = http.StatusNotFound
+			}
+			w.WriteHeader(httpStatus)
+			fmt.Fprintf(w, `{"error":{"code":%d,"status":%q,"details":[{"@type":"type.googleapis.com/google.firebase.fcm.v1.FcmError","errorCode":%q}]}}`, httpStatus, status, code)
+			return
+		}
+		fmt.Fprint(w, `{"name":"projects/test-project/messages/1"}`)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func newFCMProvider(server *httptest.Server) *FCM_Provider {
+	return &FCM_Provider{
+		Endpoint:    server.URL,
+		ProjectID:   "test-project",
+		AccessToken: func() (string, error) { return "access-token", nil },
+		Client:      server.Client(),
+	}
+}
+
+// Тестовый APNs: для токенов из statuses отвечает указанным кодом и reason
+
+func newAPNsStub(t *testing.T, key *ecdsa.PrivateKey, statuses map[string]int, reasons map[string]string) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("apns-topic") != "com.example.app" || r.Header.Get("apns-push-type") != "alert" {
+			t.Errorf("unexpected APNs headers %v", r.Header)
+		}
+		providerToken := strings.TrimPrefix(r.Header.Get("Authorization"), "bearer ")
+		claims := &jwt.RegisteredClaims{}
+		parsed, err := jwt.ParseWithClaims(providerToken, claims, func(*jwt.Token) (interface{}, error) {
+			return &key.PublicKey, nil
+		}, jwt.WithValidMethods([]string{jwt.SigningMethodES256.Alg()}))
+		if err != nil || claims.Issuer != "TEAM" || parsed.Header["kid"] != "KEY" {
+			t.Errorf("invalid APNs provider token: %v", err)
+		}
+
+		token := strings.TrimPrefix(r.URL.Path, "/3/device/")
+		if status, ok := statuses[token]; ok {
+			w.WriteHeader(status)
+			fmt.Fprintf(w, `{"reason":%q}`, reasons[token])
+			return
+		}
+		w.Header().Set("apns-id", "1")
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func newAPNsProvider(server *httptest.Server, key *ecdsa.PrivateKey) *APNs_Provider {
+	return &APNs_Provider{
+		Endpoint: server.URL,
+		Topic:    "com.example.app",
+		KeyID:    "KEY",
+		TeamID:   "TEAM",
+		Key:      key,
+		Client:   server.Client(),
+	}
+}
+
+func newECKey(t *testing.T) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+var testPush = Push_Message{Title: "Title", Body: "Body", Target: "fill_user", Notification_id: 42}
+
+func TestFCMProviderSend(t *testing.T) {
+	server := newFCMStub(t, map[string][2]string{
+		"unregistered": {"NOT_FOUND", "UNREGISTERED"},
+		"bad-payload":  {"INVALID_ARGUMENT", "INVALID_ARGUMENT"},
+	})
+	provider := newFCMProvider(server)
+
+	tests := []struct {
+		token        string
+		ok           bool
+		invalidToken bool
+	}{
+		{"valid", true, false},
+		{"unregistered", false, true},
+		{"bad-payload", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.token, func(t *testing.T) {
+			err := provider.Send(context.Background(), tt.token, testPush)
+			if (err == nil) != tt.ok || errors.Is(err, ErrInvalidToken) != tt.invalidToken {
+				t.Fatalf("Send() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestAPNsProviderSend(t *testing.T) {
+	key := newECKey(t)
+	server := newAPNsStub(t, key,
+		map[string]int{"gone": http.StatusGone, "bad-token": http.StatusBadRequest, "too-large": http.StatusRequestEntityTooLarge},
+		map[string]string{"gone": "Unregistered", "bad-token": "BadDeviceToken", "too-large": "PayloadTooLarge"})
+	provider := newAPNsProvider(server, key)
+
+	tests := []struct {
+		token        string
+		ok           bool
+		invalidToken bool
+	}{
+		{"valid", true, false},
+		{"gone", false, true},
+		{"bad-token", false, true},
+		{"too-large", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.token, func(t *testing.T) {
+			err := provider.Send(context.Background(), tt.token, testPush)
+			if (err == nil) != tt.ok || errors.Is(err, ErrInvalidToken) != tt.invalidToken {
+				t.Fatalf("Send() error = %v", err)
+			}
+		})
+	}
+}
+
+// Токены, которые провайдер признал недействительными, удаляются, остальные остаются
+
+func TestPusherPrunesInvalidTokens(t *testing.T) {
+	key := newECKey(t)
+	fcm := newFCMStub(t, map[string][2]string{
+		"fcm-unregistered": {"NOT_FOUND", "UNREGISTERED"},
+		"fcm-bad-payload":  {"INVALID_ARGUMENT", "INVALID_ARGUMENT"},
+	})
+	apns := newAPNsStub(t, key, map[string]int{"apns-gone": http.StatusGone}, map[string]string{"apns-gone": "Unregistered"})
+
+	db, fake := newFakeDB(t, func(query string, args []driver.Value) ([]string, [][]driver.Value) {
+		if strings.Contains(query, "FROM device_tokens") {
+			return []string{"token", "platform"}, [][]driver.Value{
+				{"fcm-valid", PlatformFCM},
+				{"fcm-unregistered", PlatformFCM},
+				{"fcm-bad-payload", PlatformFCM},
+				{"apns-valid", PlatformAPNs},
+				{"apns-gone", PlatformAPNs},
+			}
+		}
+		return []string{"locale"}, nil
+	})
+
+	pusher := New_Pusher(map[string]Push_Provider{
+		PlatformFCM:  newFCMProvider(fcm),
+		PlatformAPNs: newAPNsProvider(apns, key),
+	})
+	pusher.send(db, FromDB{
+		Notification_id: 42,
+		UUID:            "3f1c2a9e-5b7d-4e8f-9a0b-1c2d3e4f5a6b",
+		Notification:    `{"uuid":"3f1c2a9e-5b7d-4e8f-9a0b-1c2d3e4f5a6b","email":"user@example.com","role":"student"}`,
+		Target:          "fill_user",
+	})
+
+	execs := fake.Execs()
+	sort.Strings(execs)
+	want := []string{
+		"DELETE FROM device_tokens WHERE token=$1 [apns-gone]",
+		"DELETE FROM device_tokens WHERE token=$1 [fcm-unregistered]",
+	}
+	if strings.Join(execs, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("executed:\n%s\nwant:\n%s", strings.Join(execs, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/lib/pq"
+)
+
+// Структура запроса на отметку уведомлений.
+// Можно передать одно уведомление (notification_id) или пачку (notification_ids).
+// Если is_read не указан, уведомления отмечаются прочитанными.
+
+type ReadRequest struct {
+	Notification_id  int64   `json:"notification_id"`
+	Notification_ids []int64 `json:"notification_ids"`
+	Is_read          *bool   `json:"is_read"`
+}
+
+// Структура ответа с количеством изменённых уведомлений
+
+type ReadResponse struct {
+	Updated int64 `json:"updated"`
+}
+
+// Структура ответа счётчика непрочитанных уведомлений
+
+type UnreadCount struct {
+	Total     int64            `json:"total"`
+	By_target map[string]int64 `json:"by_target"`
+}
+
+// Функция чтения тела запроса, по умолчанию is_read = true
+
+func decodeReadRequest(r *http.Request) (ReadRequest, bool, error) {
+	var request ReadRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil && err != io.EOF {
+		return request, false, err
+	}
+	isRead := true
+	if request.Is_read != nil {
+		isRead = *request.Is_read
+	}
+	return request, isRead, nil
+}
+
+// Функция отправки количества изменённых уведомлений
+
+func writeReadResponse(w http.ResponseWriter, result sql.Result) {
+	updated, err := result.RowsAffected()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(ReadResponse{Updated: updated})
+}
+
+// Регистрируем эндпоинты отметки уведомлений прочитанными
+
+func init() {
+	Register_Routes(Read_Handlers)
+}
+
+// Функция регистрации эндпоинтов отметки уведомлений прочитанными/непрочитанными.
+// Обновляются только строки, у которых uuid совпадает с uuid из токена.
+
+func Read_Handlers(router *Router, db *sql.DB) {
+	// Отметка одного или нескольких уведомлений по Notification_id
+
+	router.Mount_Authenticated("/api/read", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		uuid := Principal_From(r.Context()).UUID
+
+		request, isRead, err := decodeReadRequest(r)
+		if err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		ids := request.Notification_ids
+		if request.Notification_id != 0 {
+			ids = append(ids, request.Notification_id)
+		}
+		if len(ids) == 0 {
+			http.Error(w, "notification_id or notification_ids is required", http.StatusBadRequest)
+			return
+		}
+
+		result, err := db.Exec("UPDATE notification_registration SET read=$1, read_at=CASE WHEN $1 THEN COALESCE(read_at, now()) END WHERE uuid=$2 AND id = ANY($3)", isRead, uuid, pq.Array(ids))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Если ни одна строка не принадлежит пользователю, отвечаем 404
+
+		if updated, err := result.RowsAffected(); err == nil && updated == 0 {
+			http.Error(w, "Notification not found", http.StatusNotFound)
+			return
+		}
+
+		writeReadResponse(w, result)
+	})
+
+	// Отметка всех уведомлений пользователя
+
+	router.Mount_Authenticated("/api/read_all", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		uuid := Principal_From(r.Context()).UUID
+
+		_, isRead, err := decodeReadRequest(r)
+		if err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+
+		result, err := db.Exec("UPDATE notification_registration SET read=$1, read_at=CASE WHEN $1 THEN COALESCE(read_at, now()) END WHERE uuid=$2 AND read<>$1", isRead, uuid)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writeReadResponse(w, result)
+	})
+	// Количество непрочитанных уведомлений для значка колокольчика.
+	// Запрос обслуживается частичным индексом по непрочитанным уведомлениям.
+	// Уведомления, отправленные в сводке, считаются один раз - самой сводкой.
+
+	router.Mount_Authenticated("/api/unread_count", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		uuid := Principal_From(r.Context()).UUID
+
+		rows, err := db.Query("SELECT target, count(*) FROM notification_registration WHERE uuid=$1 AND NOT read AND "+notDigested+" GROUP BY target", uuid)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		counts := UnreadCount{By_target: make(map[string]int64, len(Targets))}
+		for _, target := range Targets {
+			counts.By_target[target] = 0
+		}
+		for rows.Next() {
+			var target string
+			var count int64
+			if err := rows.Scan(&target, &count); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			counts.By_target[target] = count
+			counts.Total += count
+		}
+		if err := rows.Err(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(counts)
+	})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Структура маршрутизатора HTTP-запросов сервиса
+
+type Router struct {
+	mux *http.ServeMux
+}
+
+func New_Router() *Router {
+	return &Router{mux: http.NewServeMux()}
+}
+
+// Функция подключения обработчика к пути
+
+func (router *Router) Mount(pattern string, handler http.Handler) {
+	router.mux.Handle(pattern, handler)
+}
+
+func (router *Router) Mount_Func(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	router.mux.HandleFunc(pattern, handler)
+}
+
+// Функция подключения обработчика, доступного только с действительным токеном пользователя
+
+func (router *Router) Mount_Authenticated(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	router.mux.Handle(pattern, Authenticate(http.HandlerFunc(handler)))
+}
+
+func (router *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	router.mux.ServeHTTP(w, r)
+}
+
+// Функция подключения группы эндпоинтов к маршрутизатору
+
+type Routes func(router *Router, db *sql.DB)
+
+// Реестр эндпоинтов. Для нового эндпоинта достаточно объявить функцию Routes
+// и зарегистрировать её в init() своего файла.
+
+var routes []Routes
+
+// Функция регистрации группы эндпоинтов
+
+func Register_Routes(mount Routes) {
+	routes = append(routes, mount)
+}
+
+// Функция сборки маршрутизатора из всех зарегистрированных эндпоинтов
+
+func Build_Router(db *sql.DB) *Router {
+	router := New_Router()
+	for _, mount := range routes {
+		mount(router, db)
+	}
+	return router
+}
+
+// Функция создания HTTP-сервера с адресом и таймаутами из окружения.
+// WriteTimeout ограничивает обычные запросы, потоковые эндпоинты продлевают его сами.
+
+func New_Server(handler http.Handler) *http.Server {
+	readTimeout := time.Duration(Getenv_Int("NOTIF_HTTP_READ_TIMEOUT", 15)) * time.Second
+	return &http.Server{
+		Addr:              Getenv_Default("NOTIF_HTTP_ADDR", ":8080"),
+		Handler:           handler,
+		ReadTimeout:       readTimeout,
+		ReadHeaderTimeout: readTimeout,
+		WriteTimeout:      Write_Timeout(),
+		IdleTimeout:       time.Duration(Getenv_Int("NOTIF_HTTP_IDLE_TIMEOUT", 120)) * time.Second,
+	}
+}
+
+// Функция получения таймаута записи ответа
+
+func Write_Timeout() time.Duration {
+	return time.Duration(Getenv_Int("NOTIF_HTTP_WRITE_TIMEOUT", 30)) * time.Second
+}
+
+// Функция получения срока остановки сервиса
+
+func Shutdown_Timeout() time.Duration {
+	return time.Duration(Getenv_Int("NOTIF_SHUTDOWN_TIMEOUT", 20)) * time.Second
+}
+
+// Функция работы HTTP-сервера до завершения ctx. При остановке новые соединения
+// не принимаются, а текущие запросы дорабатывают не дольше NOTIF_SHUTDOWN_TIMEOUT секунд.
+// Подписки WebSocket и SSE закрываются сразу, клиенты переподключатся к другому экземпляру.
+
+func Serve(ctx context.Context, server *http.Server) {
+	server.RegisterOnShutdown(hub.Close)
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), Shutdown_Timeout())
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Printf("Failed to shut down HTTP server gracefully: %v", err)
+			server.Close()
+		}
+	}()
+
+	log.Printf("HTTP server listening on %s", server.Addr)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Fatalf("HTTP server failed: %v", err)
+	}
+	<-stopped
+	log.Printf("HTTP server stopped")
+}
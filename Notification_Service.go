@@ -1,25 +1,40 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
-	jwt "github.com/dgrijalva/jwt-go"
+	"syscall"
+	"time"
+	"github.com/golang-jwt/jwt/v5"
 
 	_ "github.com/lib/pq"
-	amqp "github.com/rabbitmq/amqp091-go"
 )
 
-// Функция выдачи ошибки
-func failOnError(err error, msg string) {
+// Функция чтения числового параметра из окружения со значением по умолчанию
+func Getenv_Int(key string, def int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
 	if err != nil {
-		log.Panicf("%s: %s", msg, err)
+		return def
 	}
+	return value
+}
+
+// Функция чтения строкового параметра из окружения со значением по умолчанию
+func Getenv_Default(key string, def string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return def
 }
 
 // Структура для принятия токена
@@ -28,17 +43,32 @@ type JWT struct {
 	Payload struct {
 		UUID string `json:"uuid"`
 	} `json:"payload"`
-	jwt.StandardClaims
+	jwt.RegisteredClaims
 }
 
 // Структура для принятия записи из базы данных
 
 type FromDB struct {
-	Notification_id int64  `json:"notification_id"`
-	UUID            string `json:"uuid"`
-	Notification    string `json:"notification"`
-	Is_Read         bool   `json:"is_read"`
-	Target          string `json:"target"`
+	Notification_id int64      `json:"notification_id"`
+	UUID            string     `json:"uuid"`
+	Notification    string     `json:"notification"`
+	Is_Read         bool       `json:"is_read"`
+	Target          string     `json:"target"`
+	Created_at      time.Time  `json:"created_at"`
+	Read_at         *time.Time `json:"read_at"`
+	Event_time      *time.Time `json:"event_time"`
+}
+
+// Колонки, которые читаются в FromDB функцией Scan_Notification
+
+const notificationColumns = "id, uuid, notification, read, target, created_at, read_at, event_time"
+
+// Функция чтения строки с колонками notificationColumns
+
+func Scan_Notification(row interface{ Scan(...interface{}) error }) (FromDB, error) {
+	var registration FromDB
+	err := row.Scan(&registration.Notification_id, &registration.UUID, &registration.Notification, &registration.Is_Read, &registration.Target, &registration.Created_at, &registration.Read_at, &registration.Event_time)
+	return registration, err
 }
 
 //объявляем структуры для Unmarshall`а поля "Notification" из базы данных
@@ -72,456 +102,269 @@ type NegotiationData struct {
 // Структура для отправляемого уведомления
 
 type SendJson struct {
-	Title           string `json:"title"`
-	Body            string `json:"body"`
-	Target          string `json:"target"`
-	Target_data     uint   `json:"target_data"`
-	Is_read         bool   `json:"is_read"`
-	Notification_id int64  `json:"notification_id"`
+	Title           string     `json:"title"`
+	Body            string     `json:"body"`
+	Target          string     `json:"target"`
+	Target_data     uint       `json:"target_data"`
+	Is_read         bool       `json:"is_read"`
+	Notification_id int64      `json:"notification_id"`
+	Created_at      time.Time  `json:"created_at"`
+	Read_at         *time.Time `json:"read_at"`
+	Event_time      *time.Time `json:"event_time"`
+
+	// Для сводки - уведомления, вошедшие в неё
+	Notification_ids []int64 `json:"notification_ids,omitempty"`
 }
 
-// Функция сохранения в бд уведомления о регистрации
-
-func Notification_Registration(wg *sync.WaitGroup) {
-	//создаём connection
-	conn, err := amqp.Dial("amqp://" + os.Getenv("RABBITMQ_USER") + ":" + os.Getenv("RABBITMQ_PASS") + "@" + os.Getenv("RABBITMQ_ADDR"))
-	failOnError(err, "Failed to connect to RabbitMQ")
-	defer conn.Close()
-	//создаём канал
-	ch, err := conn.Channel()
-	failOnError(err, "Failed to open a channel")
-	defer ch.Close()
-
-	//создаём Exchange
-	err = ch.ExchangeDeclare(
-		"main",  // name
-		"topic", // type
-		true,    // durable
-		false,   // auto-deleted
-		false,   // internal
-		false,   // no-wait
-		nil,     // arguments
-	)
-	failOnError(err, "Failed to declare an exchange")
-	//создаём очередь Queue
-	q, err := ch.QueueDeclare(
-		"Notification_Registration", // name
-		true,                        // durable
-		false,                       // delete when unused
-		false,                       // exclusive
-		false,                       // no-wait
-		nil,                         // arguments
-	)
-	failOnError(err, "Failed to declare a queue")
-
-	//делаем Binding Queue
-	err = ch.QueueBind(
-		q.Name,           // queue name
-		"user.registred", // routing key
-		"main",           // exchange
-		false,
-		nil)
-	failOnError(err, "Failed to bind a queue")
-
-	//Получаемое сообщение
-	msgs, err := ch.Consume(
-		q.Name,            // queue
-		"Notification_DB", // consumer
-		true,              // auto-ack
-		false,             // exclusive
-		false,             // no-local
-		false,             // no-wait
-		nil,               // args
-	)
-	failOnError(err, "Failed to register a consumer")
-
-	//объявляем структуру для принятого сообщения
-	type RegistredData struct {
-		UUID  string `json:"uuid"`
-		Email string `json:"email"`
-		Role  string `json:"role"`
-	}
+// Получатели уведомления о регистрации
 
-	// Устанавливаем соединение с базой данных PostgreSQL
-	db, err := sql.Open(os.Getenv("DB_NAME"), "postgres://"+os.Getenv("DB_USER")+":"+os.Getenv("DB_PASSWORD")+"@"+os.Getenv("NOTIF_DB_ADDR")+"?sslmode=disable")
-	if err != nil {
-		log.Fatalf("Failed to connect to PostgreSQL: %v", err)
-	}
-	defer db.Close()
+func (data RegistredData) Recipients() []string {
+	return []string{data.UUID}
+}
 
-	// Создаем таблицу для сообщений, если она не существует
-	_, err = db.Exec("CREATE TABLE IF NOT EXISTS notification (id SERIAL PRIMARY KEY, uuid VARCHAR(36), notification TEXT, read BOOLEAN DEFAULT false, target TEXT)")
-	if err != nil {
-		log.Fatalf("Failed to create messages table: %v", err)
-	}
+// Сохраняем почту и роль пользователя, по ним отправляются письма о других уведомлениях
 
-	var forever chan struct{}
+func (data RegistredData) Save(tx *sql.Tx) error {
+	_, err := tx.Exec("INSERT INTO users (uuid, email, role) VALUES ($1, $2, $3) ON CONFLICT (uuid) DO UPDATE SET email=EXCLUDED.email, role=EXCLUDED.role, updated_at=now()", data.UUID, data.Email, data.Role)
+	return err
+}
 
-	// Обрабатываем полученные сообщения и сохраняем их в базе данных
-	go func() {
-		for d := range msgs {
-			message := string(d.Body)
-			var RegistredData RegistredData
-			err := json.Unmarshal([]byte(message), &RegistredData)
-			if err != nil {
-				log.Fatalf("Failed to unmarshal message: %v", err)
-			}
-			uuid := RegistredData.UUID
-			target := "fill_user"
-			// Сохраняем сообщение в базе данных
-			_, err = db.Exec("INSERT INTO notification_registration (uuid, notification, target) VALUES ($1, $2, $3)", uuid, message, target)
-			if err != nil {
-				log.Fatalf("Failed to insert message into database: %v", err)
-			}
+// Получатели уведомления об изменении статуса проекта: все участники без повторов
+
+func (data ProjectStatusData) Recipients() []string {
+	seen := make(map[string]struct{}, len(data.UUID))
+	recipients := make([]string, 0, len(data.UUID))
+	for _, uuid := range data.UUID {
+		uuid = strings.TrimSpace(uuid)
+		if _, ok := seen[uuid]; ok {
+			continue
 		}
-	}()
-	<-forever
+		seen[uuid] = struct{}{}
+		recipients = append(recipients, uuid)
+	}
+	return recipients
 }
 
-// Функция сохранения в бд уведомления об изменении статуса проекта
-
-func Notification_ProjectStatus(wg *sync.WaitGroup) {
-	//создаём connection
-	conn, err := amqp.Dial("amqp://" + os.Getenv("RABBITMQ_USER") + ":" + os.Getenv("RABBITMQ_PASS") + "@" + os.Getenv("RABBITMQ_ADDR"))
-	failOnError(err, "Failed to connect to RabbitMQ")
-	defer conn.Close()
-	//создаём канал
-	ch, err := conn.Channel()
-	failOnError(err, "Failed to open a channel")
-	defer ch.Close()
-
-	//создаём Exchange
-	err = ch.ExchangeDeclare(
-		"main",  // name
-		"topic", // type
-		true,    // durable
-		false,   // auto-deleted
-		false,   // internal
-		false,   // no-wait
-		nil,     // arguments
-	)
-	failOnError(err, "Failed to declare an exchange")
-	//создаём очередь Queue
-	q, err := ch.QueueDeclare(
-		"Notification_ProjectStatus", // name
-		true,                         // durable
-		false,                        // delete when unused
-		false,                        // exclusive
-		false,                        // no-wait
-		nil,                          // arguments
-	)
-	failOnError(err, "Failed to declare a queue")
-
-	//делаем Binding Queue
-	err = ch.QueueBind(
-		q.Name,                   // queue name
-		"project.status_changed", // routing key
-		"main",                   // exchange
-		false,
-		nil)
-	failOnError(err, "Failed to bind a queue")
-
-	//Получаемое сообщение
-	msgs, err := ch.Consume(
-		q.Name,            // queue
-		"Notification_DB", // consumer
-		true,              // auto-ack
-		false,             // exclusive
-		false,             // no-local
-		false,             // no-wait
-		nil,               // args
-	)
-	failOnError(err, "Failed to register a consumer")
-
-	//объявляем структуру для принятого сообщения
-	type ProjectStatusData struct {
-		Project_id   uint     `json:"project_id"`
-		ProjectTitle string   `json:"project_title"`
-		NewStatus    string   `json:"new_status"`
-		UUID         []string `json:"uuid"`
-	}
+// Проверка события об изменении статуса: хотя бы один получатель, все uuid непустые и помещаются в колонку
 
-	// Устанавливаем соединение с базой данных PostgreSQL
-	db, err := sql.Open(os.Getenv("DB_NAME"), "postgres://"+os.Getenv("DB_USER")+":"+os.Getenv("DB_PASSWORD")+"@"+os.Getenv("NOTIF_DB_ADDR")+"?sslmode=disable")
-	if err != nil {
-		log.Fatalf("Failed to connect to PostgreSQL: %v", err)
+func (data ProjectStatusData) Validate() error {
+	if len(data.UUID) == 0 {
+		return errors.New("Status change event has no recipients")
 	}
-	defer db.Close()
-
-	// Создаем таблицу для сообщений, если она не существует
-	_, err = db.Exec("CREATE TABLE IF NOT EXISTS notification (id SERIAL PRIMARY KEY, uuid VARCHAR(36), notification TEXT, read BOOLEAN DEFAULT false, target TEXT)")
-	if err != nil {
-		log.Fatalf("Failed to create messages table: %v", err)
+	for i, uuid := range data.UUID {
+		uuid = strings.TrimSpace(uuid)
+		if uuid == "" || len(uuid) > 36 {
+			return fmt.Errorf("Invalid recipient uuid %q at position %d", uuid, i)
+		}
 	}
+	return nil
+}
 
-	var forever chan struct{}
+// Получатели уведомления об отклике на проект
 
-	// Обрабатываем полученные сообщения и сохраняем их в базе данных
-	go func() {
-		for d := range msgs {
-			message := string(d.Body)
-			var RegistredData ProjectStatusData
-			err := json.Unmarshal([]byte(message), &RegistredData)
-			if err != nil {
-				log.Fatalf("Failed to unmarshal message: %v", err)
-			}
-			uuid := RegistredData.UUID
-			firstUUID, secondUUID := uuid[0], uuid[1]
-			target := "status_changed"
-			// Сохраняем сообщения в базе данных
-			_, err = db.Exec("INSERT INTO notification_registration (uuid, notification, target) VALUES ($1, $2, $3)", firstUUID, message, target)
-			_, err = db.Exec("INSERT INTO notification_registration (uuid, notification, target) VALUES ($1, $2, $3)", secondUUID, message, target)
-			if err != nil {
-				log.Fatalf("Failed to insert message into database: %v", err)
-			}
-		}
-	}()
-	<-forever
+func (data ProjectJoinRequest) Recipients() []string {
+	return []string{data.UUID}
 }
 
-// Функция сохранения в бд уведомления об отклике на проект
-
-func Notification_ProjectJoinRequest(wg *sync.WaitGroup) {
-	//создаём connection
-	conn, err := amqp.Dial("amqp://" + os.Getenv("RABBITMQ_USER") + ":" + os.Getenv("RABBITMQ_PASS") + "@" + os.Getenv("RABBITMQ_ADDR"))
-	failOnError(err, "Failed to connect to RabbitMQ")
-	defer conn.Close()
-	//создаём канал
-	ch, err := conn.Channel()
-	failOnError(err, "Failed to open a channel")
-	defer ch.Close()
-
-	//создаём Exchange
-	err = ch.ExchangeDeclare(
-		"main",  // name
-		"topic", // type
-		true,    // durable
-		false,   // auto-deleted
-		false,   // internal
-		false,   // no-wait
-		nil,     // arguments
-	)
-	failOnError(err, "Failed to declare an exchange")
-	//создаём очередь Queue
-	q, err := ch.QueueDeclare(
-		"Notification_ProjectJoinRequest", // name
-		true,                              // durable
-		false,                             // delete when unused
-		false,                             // exclusive
-		false,                             // no-wait
-		nil,                               // arguments
-	)
-	failOnError(err, "Failed to declare a queue")
-
-	//делаем Binding Queue
-	err = ch.QueueBind(
-		q.Name,                 // queue name
-		"project.join_request", // routing key
-		"main",                 // exchange
-		false,
-		nil)
-	failOnError(err, "Failed to bind a queue")
-
-	//Получаемое сообщение
-	msgs, err := ch.Consume(
-		q.Name,            // queue
-		"Notification_DB", // consumer
-		true,              // auto-ack
-		false,             // exclusive
-		false,             // no-local
-		false,             // no-wait
-		nil,               // args
-	)
-	failOnError(err, "Failed to register a consumer")
-
-	//объявляем структуру для принятого сообщения
-	type ProjectJoinRequest struct {
-		Project_id   uint   `json:"project_id"`
-		ProjectTitle string `json:"project_title"`
-		From         string `json:"from_name"`
-		UUID         string `json:"user_uuid"`
-	}
+// Получатели уведомления о новом согласовании в проекте
+
+func (data NegotiationData) Recipients() []string {
+	return []string{data.UUID}
+}
+
+// Регистрируем обработчики событий. Для нового типа события достаточно
+// объявить структуру с методом Recipients (и при необходимости Validate и Save) и добавить её сюда.
+
+func init() {
+	Register_Handler(EventHandler{
+		Queue:      "Notification_Registration",
+		RoutingKey: "user.registred",
+		Target:     "fill_user",
+		New:        func() Event { return &RegistredData{} },
+		Email:      true,
+	})
+	Register_Handler(EventHandler{
+		Queue:      "Notification_ProjectStatus",
+		RoutingKey: "project.status_changed",
+		Target:     "status_changed",
+		New:        func() Event { return &ProjectStatusData{} },
+	})
+	Register_Handler(EventHandler{
+		Queue:      "Notification_ProjectJoinRequest",
+		RoutingKey: "project.join_request",
+		Target:     "responce",
+		New:        func() Event { return &ProjectJoinRequest{} },
+		Email:      true,
+	})
+	Register_Handler(EventHandler{
+		Queue:      "Notification_Negotaition",
+		RoutingKey: "project.negotiation.created",
+		Target:     "negotiation",
+		New:        func() Event { return &NegotiationData{} },
+		Email:      true,
+	})
+}
 
-	// Устанавливаем соединение с базой данных PostgreSQL
+// Функция подключения к базе данных PostgreSQL
+
+func Open_DB() *sql.DB {
 	db, err := sql.Open(os.Getenv("DB_NAME"), "postgres://"+os.Getenv("DB_USER")+":"+os.Getenv("DB_PASSWORD")+"@"+os.Getenv("NOTIF_DB_ADDR")+"?sslmode=disable")
 	if err != nil {
 		log.Fatalf("Failed to connect to PostgreSQL: %v", err)
 	}
-	defer db.Close()
+	return db
+}
 
-	// Создаем таблицу для сообщений, если она не существует
-	_, err = db.Exec("CREATE TABLE IF NOT EXISTS notification (id SERIAL PRIMARY KEY, uuid VARCHAR(36), notification TEXT, read BOOLEAN DEFAULT false, target TEXT)")
-	if err != nil {
-		log.Fatalf("Failed to create messages table: %v", err)
-	}
+// Функция формирования отправляемого уведомления из записи базы данных.
+// Заголовок и текст берутся из шаблонов target на языке locale.
 
-	var forever chan struct{}
+func Build_Notification(registration FromDB, locale string) (SendJson, error) {
+	// Начианаем формировать отправляемый json
+	var Sent_Notification SendJson
+	Sent_Notification.Notification_id = registration.Notification_id
+	Sent_Notification.Is_read = registration.Is_Read
+	Sent_Notification.Target = registration.Target
+	Sent_Notification.Created_at = registration.Created_at
+	Sent_Notification.Read_at = registration.Read_at
+	Sent_Notification.Event_time = registration.Event_time
 
-	// Обрабатываем полученные сообщения и сохраняем их в базе данных
-	go func() {
-		for d := range msgs {
-			message := string(d.Body)
-			var RegistredData ProjectJoinRequest
-			err := json.Unmarshal([]byte(message), &RegistredData)
-			if err != nil {
-				log.Fatalf("Failed to unmarshal message: %v", err)
-			}
-			uuid := RegistredData.UUID
-			target := "responce"
-			// Сохраняем сообщение в базе данных
-			_, err = db.Exec("INSERT INTO notification_registration (uuid, notification, target) VALUES ($1, $2, $3)", uuid, message, target)
-			if err != nil {
-				log.Fatalf("Failed to insert message into database: %v", err)
-			}
+	// В зависимости от "target" распаковываем данные для шаблона
+
+	var Unpack_Notific interface{}
+
+	switch registration.Target {
+
+	// Для "Согласования"
+
+	case "negotiation":
+		var data NegotiationData
+		err := json.Unmarshal([]byte(registration.Notification), &data)
+		if err != nil {
+			return Sent_Notification, fmt.Errorf("Failed to unmarshal notification %d: %w", registration.Notification_id, err)
 		}
-	}()
-	<-forever
-}
+		Unpack_Notific = data
+		Sent_Notification.Target_data = data.Project_id
 
-// Функция сохранения в бд уведомления о новом согласовании в проекте
-
-func Notification_Negotaition(wg *sync.WaitGroup) {
-	//создаём connection
-	conn, err := amqp.Dial("amqp://" + os.Getenv("RABBITMQ_USER") + ":" + os.Getenv("RABBITMQ_PASS") + "@" + os.Getenv("RABBITMQ_ADDR"))
-	failOnError(err, "Failed to connect to RabbitMQ")
-	defer conn.Close()
-	//создаём канал
-	ch, err := conn.Channel()
-	failOnError(err, "Failed to open a channel")
-	defer ch.Close()
-
-	//создаём Exchange
-	err = ch.ExchangeDeclare(
-		"main",  // name
-		"topic", // type
-		true,    // durable
-		false,   // auto-deleted
-		false,   // internal
-		false,   // no-wait
-		nil,     // arguments
-	)
-	failOnError(err, "Failed to declare an exchange")
-	//создаём очередь Queue
-	q, err := ch.QueueDeclare(
-		"Notification_Negotaition", // name
-		true,                       // durable
-		false,                      // delete when unused
-		false,                      // exclusive
-		false,                      // no-wait
-		nil,                        // arguments
-	)
-	failOnError(err, "Failed to declare a queue")
-
-	//делаем Binding Queue
-	err = ch.QueueBind(
-		q.Name,                        // queue name
-		"project.negotiation.created", // routing key
-		"main",                        // exchange
-		false,
-		nil)
-	failOnError(err, "Failed to bind a queue")
-
-	//Получаемое сообщение
-	msgs, err := ch.Consume(
-		q.Name,            // queue
-		"Notification_DB", // consumer
-		true,              // auto-ack
-		false,             // exclusive
-		false,             // no-local
-		false,             // no-wait
-		nil,               // args
-	)
-	failOnError(err, "Failed to register a consumer")
-
-	//объявляем структуру для принятого сообщения
-	type NegotiationData struct {
-		Project_id   uint   `json:"project_id"`
-		ProjectTitle string `json:"project_title"`
-		UUID         string `json:"user_uuid"`
-	}
+	// Для "Отклика"
 
-	// Устанавливаем соединение с базой данных PostgreSQL
-	db, err := sql.Open(os.Getenv("DB_NAME"), "postgres://"+os.Getenv("DB_USER")+":"+os.Getenv("DB_PASSWORD")+"@"+os.Getenv("NOTIF_DB_ADDR")+"?sslmode=disable")
-	if err != nil {
-		log.Fatalf("Failed to connect to PostgreSQL: %v", err)
-	}
-	defer db.Close()
+	case "responce":
+		var data ProjectJoinRequest
+		err := json.Unmarshal([]byte(registration.Notification), &data)
+		if err != nil {
+			return Sent_Notification, fmt.Errorf("Failed to unmarshal notification %d: %w", registration.Notification_id, err)
+		}
+		Unpack_Notific = data
+		Sent_Notification.Target_data = data.Project_id
 
-	// Создаем таблицу для сообщений, если она не существует
-	_, err = db.Exec("CREATE TABLE IF NOT EXISTS notification (id SERIAL PRIMARY KEY, uuid VARCHAR(36), notification TEXT, read BOOLEAN DEFAULT false, target TEXT)")
-	if err != nil {
-		log.Fatalf("Failed to create messages table: %v", err)
-	}
+	// Для "Изменение статуса"
 
-	var forever chan struct{}
+	case "status_changed":
+		var data ProjectStatusData
+		err := json.Unmarshal([]byte(registration.Notification), &data)
+		if err != nil {
+			return Sent_Notification, fmt.Errorf("Failed to unmarshal notification %d: %w", registration.Notification_id, err)
+		}
+		Unpack_Notific = data
+		Sent_Notification.Target_data = data.Project_id
 
-	// Обрабатываем полученные сообщения и сохраняем их в базе данных
-	go func() {
-		for d := range msgs {
-			message := string(d.Body)
-			var RegistredData NegotiationData
-			err := json.Unmarshal([]byte(message), &RegistredData)
-			if err != nil {
-				log.Fatalf("Failed to unmarshal message: %v", err)
-			}
-			uuid := RegistredData.UUID
-			target := "negotiation"
-			// Сохраняем сообщение в базе данных
-			_, err = db.Exec("INSERT INTO notification_registration (uuid, notification, target) VALUES ($1, $2, $3)", uuid, message, target)
-			if err != nil {
-				log.Fatalf("Failed to insert message into database: %v", err)
-			}
+	// Для "Заполните профиль"
+
+	case "fill_user":
+		var data RegistredData
+		err := json.Unmarshal([]byte(registration.Notification), &data)
+		if err != nil {
+			return Sent_Notification, fmt.Errorf("Failed to unmarshal notification %d: %w", registration.Notification_id, err)
 		}
-	}()
-	<-forever
-}
+		Unpack_Notific = data
+		Sent_Notification.Target_data = 0
 
-// Функция выдачи ответа на GET-запрос
+	// Для "Сводки"
 
-func Requestions(wg *sync.WaitGroup) {
-	// Устанавливаем соединение с базой данных PostgreSQL
-	db, err := sql.Open(os.Getenv("DB_NAME"), "postgres://"+os.Getenv("DB_USER")+":"+os.Getenv("DB_PASSWORD")+"@"+os.Getenv("NOTIF_DB_ADDR")+"?sslmode=disable")
+	case DigestTarget:
+		var data DigestData
+		err := json.Unmarshal([]byte(registration.Notification), &data)
+		if err != nil {
+			return Sent_Notification, fmt.Errorf("Failed to unmarshal notification %d: %w", registration.Notification_id, err)
+		}
+		Unpack_Notific = data
+		Sent_Notification.Target_data = data.Project_id
+		Sent_Notification.Notification_ids = data.Notification_ids
+
+	// Обработка неизвестных значений
+
+	default:
+		fmt.Println(`Не удалось определить "Registration.Target" и классифицировать уведомление`)
+		return Sent_Notification, nil
+	}
+
+	title, body, err := renderer.Render(locale, registration.Target, Unpack_Notific)
 	if err != nil {
-		log.Fatalf("Failed to connect to PostgreSQL: %v", err)
+		return Sent_Notification, fmt.Errorf("Failed to render notification %d: %w", registration.Notification_id, err)
 	}
-	defer db.Close()
+	Sent_Notification.Title = title
+	Sent_Notification.Body = body
 
-	var forever chan struct{}
+	return Sent_Notification, nil
+}
 
-	// Принимаем запрос с токеном
+// Функция запуска HTTP-сервера со всеми зарегистрированными эндпоинтами
 
-	claims := &JWT{}
+func Requestions(ctx context.Context, db *sql.DB, wg *sync.WaitGroup) {
+	defer wg.Done()
 
-	http.HandleFunc("/api", func(w http.ResponseWriter, r *http.Request) {
-		token := r.Header.Get("Authorization")
-		if token == "" {
-			http.Error(w, "Authorization header is missing", http.StatusUnauthorized)
-			return
-		}
+	Serve(ctx, New_Server(Build_Router(db)))
+}
+
+func init() {
+	Register_Routes(List_Handlers)
+}
 
-		// Парсим токен
+// Функция регистрации эндпоинтов состояния сервиса и списка уведомлений
 
-		splitToken := strings.Split(token, "Bearer ")
-		if len(splitToken) != 2 {
-			http.Error(w, "Invalid token format", http.StatusUnauthorized)
-			return
+func List_Handlers(router *Router, db *sql.DB) {
+	// Состояние сервиса и соединения с RabbitMQ
+
+	router.Mount_Func("/health", func(w http.ResponseWriter, r *http.Request) {
+		status := broker.Status()
+		w.Header().Set("Content-Type", "application/json")
+		if status.State == BrokerConnected {
+			w.WriteHeader(http.StatusOK)
+		} else {
+			w.WriteHeader(http.StatusServiceUnavailable)
 		}
+		json.NewEncoder(w).Encode(map[string]BrokerStatus{"rabbitmq": status})
+	})
+
+	// Список уведомлений пользователя
+
+	router.Mount_Authenticated("/api", func(w http.ResponseWriter, r *http.Request) {
+		// Принимаем запрос с токеном
 
-		tokenString := splitToken[1]
-		_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
-			return []byte(os.Getenv("JWT_SECRET")), nil // ЗАМЕНИТЬ НА СЕКРЕТНЫЙ КЛЮЧ!!!!
-		})
+		uuid := Principal_From(r.Context()).UUID
 
+		// Разбираем параметры страницы и фильтры
+
+		filter, err := Parse_List_Filter(r)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusUnauthorized)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		uuid := claims.Payload.UUID
+		// Язык уведомлений
+
+		locale := Request_Locale(db, r, uuid)
+
+		// Уведомления, сгруппированные по проекту
+
+		if filter.Group {
+			Write_Groups(w, db, filter, uuid, locale)
+			return
+		}
 
 		// Ищем совпадения uuid в строках БД с uuid из токена и сохраняем совпадающие записи в переменную
 
-		rows, err := db.Query("SELECT * FROM notification_registration WHERE uuid=$1", uuid)
+		query, args := filter.Query(uuid)
+		rows, err := db.Query(query, args...)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -530,84 +373,34 @@ func Requestions(wg *sync.WaitGroup) {
 
 		//Обрабатываем каждое уведомление
 
-		var registrations string
+		notifications := []SendJson{}
+		var count int
+		var last FromDB
 
 		for rows.Next() {
-			var registration FromDB
-			err := rows.Scan(&registration.Notification_id, &registration.UUID, &registration.Notification, &registration.Is_Read, &registration.Target)
+			// Лишняя строка означает, что есть следующая страница
+			count++
+			if count > filter.Limit {
+				w.Header().Set("X-Next-Cursor", filter.Next_Cursor(last))
+				break
+			}
+
+			registration, err := Scan_Notification(rows)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
+			last = registration
 
-			// Начианаем формировать отправляемый json
-			var Sent_Notification SendJson
-			Sent_Notification.Notification_id = registration.Notification_id
-			Sent_Notification.Is_read = registration.Is_Read
-			Sent_Notification.Target = registration.Target
-
-			// В зависимости от "target" формируем оставшиеся поля отправляемого уведомления
-
-			switch registration.Target {
-
-			// Для "Согласования"
-
-			case "negotiation":
-				var Unpack_Notific NegotiationData
-				err := json.Unmarshal([]byte(registration.Notification), &Unpack_Notific)
-				if err != nil {
-					log.Fatalf("Failed to unmarshal message: %v", err)
-				}
-				Sent_Notification.Title = "Согласование"
-				Sent_Notification.Body = fmt.Sprintf("В проекте %s необходимо произвести согласование.", Unpack_Notific.ProjectTitle)
-				Sent_Notification.Target_data = Unpack_Notific.Project_id
-			// Для "Отклика"
-
-			case "responce":
-				var Unpack_Notific ProjectJoinRequest
-				err := json.Unmarshal([]byte(registration.Notification), &Unpack_Notific)
-				if err != nil {
-					log.Fatalf("Failed to unmarshal message: %v", err)
-				}
-				Sent_Notification.Title = "Отклик"
-				Sent_Notification.Body = fmt.Sprintf("На проект %s откликнулся исполнитель %s.", Unpack_Notific.ProjectTitle, Unpack_Notific.From)
-				Sent_Notification.Target_data = Unpack_Notific.Project_id
-
-			// Для "Изменение статуса"
-
-			case "status_changed":
-				var Unpack_Notific ProjectStatusData
-				err := json.Unmarshal([]byte(registration.Notification), &Unpack_Notific)
-				if err != nil {
-					log.Fatalf("Failed to unmarshal message: %v", err)
-				}
-				Sent_Notification.Title = "Изменение статуса"
-				Sent_Notification.Body = fmt.Sprintf("Статус проекта %s изменён на %s.", Unpack_Notific.ProjectTitle, Unpack_Notific.NewStatus)
-				Sent_Notification.Target_data = Unpack_Notific.Project_id
-			// Для "Заполните профиль"
-
-			case "fill_user":
-				var Unpack_Notific RegistredData
-				err := json.Unmarshal([]byte(registration.Notification), &Unpack_Notific)
-				if err != nil {
-					log.Fatalf("Failed to unmarshal message: %v", err)
-				}
-				Sent_Notification.Title = "Успешная регистрация"
-				Sent_Notification.Body = fmt.Sprintf("Добро пожаловать на наш сервис, %s. Вы зарегистрированы в роли %s Для завершени регистрации заполните профиль.", Unpack_Notific.Email, Unpack_Notific.Role)
-				Sent_Notification.Target_data = 0
-			// Обработка неизвестных значений
-
-			default:
-				fmt.Println(`Не удалось определить "Registration.Target" и классифицировать уведомление`)
+			// Формируем отправляемый json
+			Sent_Notification, err := Build_Notification(registration, locale)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
 			}
 
-			// Делаем Marshall отправляемого json и переводим его в string, чтобы накапливать в массиве
-			Mrshl_Sent_Notification, err := json.Marshal(Sent_Notification)
-			strSentNotification := string(Mrshl_Sent_Notification)
-
-			// Накапливаем Уведомления в одну переменную
-			var registrations []string
-			registrations = append(registrations, strSentNotification)
+			// Накапливаем уведомления в массиве
+			notifications = append(notifications, Sent_Notification)
 		}
 
 		// Проверяем на ошибки после выхода из цикла
@@ -619,52 +412,46 @@ func Requestions(wg *sync.WaitGroup) {
 
 		// Отправляем полученный массив на фронтэнд
 
+		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(registrations)
-		<-forever
+		json.NewEncoder(w).Encode(notifications)
 	})
 }
 
-// Мы создаем пул горутин с помощью канала pool. Размер пула определяется переменной poolSize. 
-// Затем мы запускаем пять функций в своих горутинах, каждая из которых будет выполнять свою работу. 
-// Функции запускаются с помощью анонимных функций, которые добавляются в пул горутин и выполняются параллельно.
-// Мы используем структуру struct{}{} в качестве элемента пула горутин. Это пустая структура, которая не занимает дополнительной памяти и 
-// служит только для синхронизации работы горутин в пуле.
+// Открываем один пул соединений с базой данных, общий для консьюмеров и HTTP-обработчиков,
+// применяем миграции и запускаем их в своих горутинах.
+// Подкоманда "migrate up | down [steps] | version" только управляет схемой базы данных.
 
 func main() {
-	for {
-		var wg sync.WaitGroup
-
-		poolSize := 5
-		pool := make(chan struct{}, poolSize)
-
-		wg.Add(5)
-		go func() {
-		pool <- struct{}{}
-		Notification_Registration(&wg)
-		<-pool
-		}()
-		go func() {
-		pool <- struct{}{}
-		Notification_ProjectStatus(&wg)
-		<-pool
-		}()
-		go func() {
-		pool <- struct{}{}
-		Notification_ProjectJoinRequest(&wg)
-		<-pool
-		}()
-		go func() {
-		pool <- struct{}{}
-		Notification_Negotaition(&wg)
-		<-pool
-		}()
-		go func() {
-		pool <- struct{}{}
-		Requestions(&wg)
-		<-pool
-		}()
-
-		wg.Wait()
+	db := Open_DB()
+	defer db.Close()
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := Migrate_Command(db, os.Args[2:]); err != nil {
+			log.Fatalf("Migration failed: %v", err)
+		}
+		return
 	}
+
+	// Миграции при старте можно отключить и запускать подкомандой отдельно
+	if os.Getenv("NOTIF_MIGRATE_ON_START") != "false" {
+		if err := Migrate_Up(db); err != nil {
+			log.Fatalf("Migration failed: %v", err)
+		}
+	}
+
+	// По SIGTERM (Kubernetes) или Ctrl+C прекращаем приём сообщений и запросов,
+	// дожидаемся обработки текущих и закрываем соединения
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var wg sync.WaitGroup
+
+	wg.Add(2)
+	go Run_Consumers(ctx, db, &wg)
+	go Requestions(ctx, db, &wg)
+
+	wg.Wait()
+	log.Printf("Shutdown complete")
 }
\ No newline at end of file
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// Событие об изменении статуса без получателей или с некорректными uuid отклоняется,
+// а не приводит к панике, повторы получателей отбрасываются
+
+func TestProjectStatusDataRecipients(t *testing.T) {
+	first := "3f1c2a9e-5b7d-4e8f-9a0b-1c2d3e4f5a6b"
+	second := "7a8b9c0d-1e2f-4a3b-8c4d-5e6f7a8b9c0d"
+	third := "0b1c2d3e-4f5a-4b6c-9d7e-8f9a0b1c2d3e"
+
+	tests := []struct {
+		name string
+		body string
+		ok   bool
+		want []string
+	}{
+		{"no recipients", `{"project_id": 1, "uuid": []}`, false, nil},
+		{"no uuid field", `{"project_id": 1}`, false, nil},
+		{"one recipient", `{"project_id": 1, "uuid": ["` + first + `"]}`, true, []string{first}},
+		{"three recipients", `{"project_id": 1, "uuid": ["` + first + `", "` + second + `", "` + third + `"]}`, true, []string{first, second, third}},
+		{"duplicates with whitespace", `{"project_id": 1, "uuid": ["` + first + `", " ` + first + `\n", "` + second + `"]}`, true, []string{first, second}},
+		{"blank uuid", `{"project_id": 1, "uuid": ["` + first + `", "  "]}`, false, nil},
+		{"uuid longer than 36", `{"project_id": 1, "uuid": ["` + first + `0"]}`, false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var data ProjectStatusData
+			if err := json.Unmarshal([]byte(tt.body), &data); err != nil {
+				t.Fatal(err)
+			}
+			err := data.Validate()
+			if (err == nil) != tt.ok {
+				t.Fatalf("Validate() error = %v", err)
+			}
+			if !tt.ok {
+				return
+			}
+			if got := data.Recipients(); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Fatalf("Recipients() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Функция отправки одного уведомления в формате Server-Sent Events.
+// Notification_id используется как id события для Last-Event-ID.
+
+func writeEvent(w http.ResponseWriter, notification SendJson) error {
+	data, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: notification\ndata: %s\n\n", notification.Notification_id, data)
+	return err
+}
+
+// Функция определения последнего полученного клиентом уведомления.
+// Браузер сам передаёт Last-Event-ID при переподключении, при первом
+// подключении его можно передать параметром last_event_id.
+
+func lastEventID(r *http.Request) (int64, error) {
+	value := r.Header.Get("Last-Event-ID")
+	if value == "" {
+		value = r.URL.Query().Get("last_event_id")
+	}
+	if value == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(value, 10, 64)
+}
+
+// Регистрируем эндпоинт Server-Sent Events
+
+func init() {
+	Register_Routes(Stream_Handlers)
+}
+
+// Функция регистрации SSE-эндпоинта, альтернативы WebSocket для клиентов за прокси.
+// EventSource не передаёт заголовки, поэтому токен можно передать параметром token.
+
+func Stream_Handlers(router *Router, db *sql.DB) {
+	router.Mount("/api/stream", Authenticate_Query(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		uuid := Principal_From(r.Context()).UUID
+
+		lastID, err := lastEventID(r)
+		if err != nil {
+			http.Error(w, "Invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming is not supported", http.StatusInternalServerError)
+			return
+		}
+
+		locale := Request_Locale(db, r, uuid)
+
+		// Подписываемся до чтения пропущенных уведомлений, чтобы ничего не потерять между запросом и подпиской
+
+		notifications, unsubscribe := hub.Subscribe(uuid)
+		defer unsubscribe()
+
+		// Поток живёт дольше таймаутов сервера: снимаем ограничение на чтение запроса,
+		// а срок записи продлеваем перед каждой отправкой
+
+		controller := http.NewResponseController(w)
+		controller.SetReadDeadline(time.Time{})
+		extendWrite := func() {
+			controller.SetWriteDeadline(time.Now().Add(Write_Timeout()))
+		}
+		extendWrite()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, "retry: 3000\n\n")
+
+		// Досылаем уведомления, пропущенные с момента Last-Event-ID.
+		// backlogMax - наибольший отправленный из них id, живые уведомления его не двигают:
+		// потребители сохраняют уведомления в разных транзакциях и id приходят не по порядку
+
+		backlogMax := lastID
+		if lastID > 0 {
+			rows, err := db.Query("SELECT "+notificationColumns+" FROM notification_registration WHERE uuid=$1 AND id>$2 AND "+notDigested+" ORDER BY id LIMIT $3", uuid, lastID, Getenv_Int("NOTIF_STREAM_BACKLOG", 500))
+			if err != nil {
+				log.Printf("Failed to load missed notifications for %s: %v", uuid, err)
+				return
+			}
+			for rows.Next() {
+				registration, err := Scan_Notification(rows)
+				if err != nil {
+					log.Printf("Failed to scan missed notification for %s: %v", uuid, err)
+					break
+				}
+				notification, err := Build_Notification(registration, locale)
+				if err != nil {
+					log.Print(err)
+					continue
+				}
+				if err := writeEvent(w, notification); err != nil {
+					break
+				}
+				backlogMax = notification.Notification_id
+			}
+			rows.Close()
+		}
+		flusher.Flush()
+
+		heartbeat := time.NewTicker(time.Duration(Getenv_Int("NOTIF_SSE_HEARTBEAT", 15)) * time.Second)
+		defer heartbeat.Stop()
+
+		for {
+			select {
+			case registration, ok := <-notifications:
+				// сервис останавливается, клиент переподключится с Last-Event-ID
+				if !ok {
+					return
+				}
+				// Уведомление уже могло быть отправлено из пропущенных
+				if registration.Notification_id <= backlogMax {
+					continue
+				}
+				notification, err := Build_Notification(registration, locale)
+				if err != nil {
+					log.Print(err)
+					continue
+				}
+				extendWrite()
+				if err := writeEvent(w, notification); err != nil {
+					return
+				}
+				flusher.Flush()
+			case <-heartbeat.C:
+				extendWrite()
+				if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+					return
+				}
+				flusher.Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})))
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Шаблон одного target для одного языка и время изменения файла, из которого он прочитан
+
+type templateFile struct {
+	tmpl    *template.Template
+	modTime time.Time
+}
+
+// Структура шаблонизатора уведомлений. Шаблоны лежат в файлах <dir>/<locale>/<target>.tmpl
+// и определяют блоки "title" и "body". Изменённый файл перечитывается при следующем
+// использовании, поэтому тексты можно править без пересборки сервиса.
+
+type Renderer struct {
+	dir      string
+	fallback string
+	mu       sync.Mutex
+	cache    map[string]*templateFile
+}
+
+// Общий шаблонизатор
+
+var renderer = New_Renderer(Getenv_Default("NOTIF_TEMPLATES_DIR", "templates"), Getenv_Default("NOTIF_DEFAULT_LOCALE", "ru"))
+
+func New_Renderer(dir string, fallback string) *Renderer {
+	return &Renderer{dir: dir, fallback: Normalize_Locale(fallback), cache: make(map[string]*templateFile)}
+}
+
+var localePattern = regexp.MustCompile(`^[a-z]{2,3}(-[a-z0-9]{2,8})*$`)
+
+// Функция приведения языка к виду имени каталога: "en_US" -> "en-us".
+// Недопустимое значение превращается в пустую строку.
+
+func Normalize_Locale(locale string) string {
+	locale = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(locale), "_", "-"))
+	if !localePattern.MatchString(locale) {
+		return ""
+	}
+	return locale
+}
+
+// Функция проверки, что для языка есть каталог с шаблонами
+
+func (r *Renderer) Has_Locale(locale string) bool {
+	locale = Normalize_Locale(locale)
+	if locale == "" {
+		return false
+	}
+	info, err := os.Stat(filepath.Join(r.dir, locale))
+	return err == nil && info.IsDir()
+}
+
+// Функция выбора первого языка из списка, для которого есть шаблоны.
+// Для "en-us" проверяется также "en". Если ничего не подошло - язык по умолчанию.
+
+func (r *Renderer) Resolve_Locale(candidates ...string) string {
+	for _, candidate := range candidates {
+		locale := Normalize_Locale(candidate)
+		for locale != "" {
+			if r.Has_Locale(locale) {
+				return locale
+			}
+			i := strings.LastIndex(locale, "-")
+			if i < 0 {
+				break
+			}
+			locale = locale[:i]
+		}
+	}
+	return r.fallback
+}
+
+// Функция получения шаблона с перечитыванием изменённого файла
+
+func (r *Renderer) load(locale string, target string) (*template.Template, error) {
+	path := filepath.Join(r.dir, locale, target+".tmpl")
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	cached := r.cache[path]
+	if cached != nil && cached.modTime.Equal(info.ModTime()) {
+		return cached.tmpl, nil
+	}
+
+	tmpl, err := template.ParseFiles(path)
+	if err != nil {
+		return nil, err
+	}
+	r.cache[path] = &templateFile{tmpl: tmpl, modTime: info.ModTime()}
+	return tmpl, nil
+}
+
+// Функция формирования заголовка и текста уведомления. Если для языка нет шаблона target,
+// используется шаблон языка по умолчанию.
+
+func (r *Renderer) Render(locale string, target string, data interface{}) (string, string, error) {
+	tmpl, err := r.load(locale, target)
+	if os.IsNotExist(err) && locale != r.fallback {
+		tmpl, err = r.load(r.fallback, target)
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("No template for %s: %w", target, err)
+	}
+
+	var title, body bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&title, "title", data); err != nil {
+		return "", "", err
+	}
+	if err := tmpl.ExecuteTemplate(&body, "body", data); err != nil {
+		return "", "", err
+	}
+	return strings.TrimSpace(title.String()), strings.TrimSpace(body.String()), nil
+}
+
+// Функция разбора заголовка Accept-Language в список языков по убыванию веса
+
+func Parse_Accept_Language(header string) []string {
+	type weighted struct {
+		locale string
+		q      float64
+	}
+	var languages []weighted
+	for _, part := range strings.Split(header, ",") {
+		locale, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if locale == "" || locale == "*" {
+			continue
+		}
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				q = parsed
+			}
+		}
+		if q > 0 {
+			languages = append(languages, weighted{locale, q})
+		}
+	}
+	sort.SliceStable(languages, func(i, j int) bool { return languages[i].q > languages[j].q })
+
+	locales := make([]string, len(languages))
+	for i, language := range languages {
+		locales[i] = language.locale
+	}
+	return locales
+}
+
+// Функция получения языка, выбранного пользователем, пустая строка - не выбран
+
+func User_Locale(q Querier, uuid string) (string, error) {
+	var locale string
+	err := q.QueryRow("SELECT locale FROM user_locales WHERE uuid=$1", uuid).Scan(&locale)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return locale, err
+}
+
+// Функция выбора языка ответа: язык из настроек пользователя, затем Accept-Language, затем язык по умолчанию
+
+func Request_Locale(db *sql.DB, r *http.Request, uuid string) string {
+	locale, err := User_Locale(db, uuid)
+	if err != nil {
+		locale = ""
+	}
+	return renderer.Resolve_Locale(append([]string{locale}, Parse_Accept_Language(r.Header.Get("Accept-Language"))...)...)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// Время на отправку одного сообщения клиенту
+	wsWriteWait = 10 * time.Second
+	// Если за это время не пришёл pong, соединение считается потерянным
+	wsPongWait = 60 * time.Second
+	// Период отправки ping, должен быть меньше wsPongWait
+	wsPingPeriod = wsPongWait * 9 / 10
+)
+
+// Фронтэнд может находиться на другом домене. Проверять Origin не нужно,
+// так как соединение авторизуется токеном, а не cookie.
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     func(r *http.Request) bool { return true },
+}
+
+// Регистрируем эндпоинт WebSocket для получения новых уведомлений в реальном времени
+
+func init() {
+	Register_Routes(func(router *Router, db *sql.DB) {
+		router.Mount("/api/ws", Authenticate_Query(WebSocket_Handler(db)))
+	})
+}
+
+// Функция обработки WebSocket-соединения: после проверки токена
+// все новые уведомления пользователя отправляются клиенту в виде SendJson
+
+func WebSocket_Handler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		Serve_WebSocket(db, w, r)
+	}
+}
+
+func Serve_WebSocket(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	uuid := Principal_From(r.Context()).UUID
+	locale := Request_Locale(db, r, uuid)
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("Failed to upgrade WebSocket connection: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	notifications, unsubscribe := hub.Subscribe(uuid)
+	defer unsubscribe()
+
+	// Читаем входящие сообщения только для обработки pong и закрытия соединения клиентом
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		conn.SetReadLimit(512)
+		conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		})
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(wsPingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case registration, ok := <-notifications:
+			// сервис останавливается
+			if !ok {
+				conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"))
+				return
+			}
+			notification, err := Build_Notification(registration, locale)
+			if err != nil {
+				log.Print(err)
+				continue
+			}
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := conn.WriteJSON(notification); err != nil {
+				return
+			}
+		case <-ticker.C:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
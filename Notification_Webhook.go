@@ -0,0 +1,528 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Структура подписки внешней системы на уведомления.
+// Пустой Targets - подписка на все target.
+
+type Webhook struct {
+	Id         int64     `json:"id"`
+	Url        string    `json:"url"`
+	Secret     string    `json:"secret,omitempty"`
+	Targets    []string  `json:"targets"`
+	Enabled    bool      `json:"enabled"`
+	Failures   int       `json:"failures"`
+	Created_at time.Time `json:"created_at"`
+	Updated_at time.Time `json:"updated_at"`
+}
+
+const webhookColumns = "id, url, secret, targets, enabled, failures, created_at, updated_at"
+
+// Функция чтения подписки из строки результата запроса с webhookColumns
+
+func Scan_Webhook(row interface{ Scan(...interface{}) error }) (Webhook, error) {
+	var webhook Webhook
+	err := row.Scan(&webhook.Id, &webhook.Url, &webhook.Secret, pq.Array(&webhook.Targets), &webhook.Enabled, &webhook.Failures, &webhook.Created_at, &webhook.Updated_at)
+	if webhook.Targets == nil {
+		webhook.Targets = []string{}
+	}
+	return webhook, err
+}
+
+// Тело запроса, которое получает внешняя система.
+// Delivery_id не меняется между повторными попытками, по нему можно отбрасывать дубли.
+
+type Webhook_Event struct {
+	Delivery_id  string          `json:"delivery_id"`
+	UUID         string          `json:"uuid"`
+	Notification SendJson        `json:"notification"`
+	Data         json.RawMessage `json:"data"`
+}
+
+// Функция подписи тела запроса: HMAC-SHA256 от "<timestamp>.<body>" на секрете подписки.
+// Получатель проверяет заголовок X-Webhook-Signature: sha256=<hex> и отбрасывает
+// запросы со старым X-Webhook-Timestamp.
+
+func Sign_Webhook(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Одна доставка уведомления в одну подписку
+
+type webhookJob struct {
+	webhook Webhook
+	event   Webhook_Event
+	body    []byte
+}
+
+// Структура очереди вебхуков: уведомления раскладываются по подходящим подпискам
+// и доставляются несколькими горутинами, чтобы медленный получатель не задерживал остальных
+
+type Webhook_Dispatcher struct {
+	queue    chan FromDB
+	jobs     chan webhookJob
+	client   *http.Client
+	delivery *Delivery_Queue
+}
+
+// Общая очередь вебхуков
+
+var webhooks = New_Webhook_Dispatcher()
+
+func New_Webhook_Dispatcher() *Webhook_Dispatcher {
+	return &Webhook_Dispatcher{
+		queue:    make(chan FromDB, Getenv_Int("NOTIF_WEBHOOK_QUEUE", 100)),
+		jobs:     make(chan webhookJob),
+		delivery: New_Delivery_Queue("Webhook"),
+		client: &http.Client{
+			Timeout: time.Duration(Getenv_Int("WEBHOOK_TIMEOUT", 10)) * time.Second,
+			// перенаправления не выполняем, ответ 3xx считается ошибкой
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+}
+
+// Функция постановки уведомления в очередь, при переполнении уведомление пропускается
+
+func (d *Webhook_Dispatcher) Enqueue(registration FromDB) {
+	accepted := d.delivery.Accept(func() {
+		select {
+		case d.queue <- registration:
+		default:
+			log.Printf("Webhook queue is full, notification %d for %s dropped", registration.Notification_id, registration.UUID)
+		}
+	})
+	if !accepted {
+		log.Printf("Webhook queue is stopped, notification %d for %s dropped", registration.Notification_id, registration.UUID)
+	}
+}
+
+// Функция остановки: новые уведомления не принимаются, уведомления из очереди
+// доставляются до завершения ctx, журнал доставок дописывается до закрытия базы данных
+
+func (d *Webhook_Dispatcher) Stop(ctx context.Context) error {
+	return d.delivery.Stop(ctx, func() { close(d.queue) }, func() int { return len(d.queue) })
+}
+
+// Функция раскладывания уведомлений из очереди по включённым подпискам
+
+func (d *Webhook_Dispatcher) Run(db *sql.DB) {
+	defer d.delivery.Finish()
+
+	var workers sync.WaitGroup
+	for i := 0; i < Getenv_Int("WEBHOOK_WORKERS", 4); i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for job := range d.jobs {
+				d.deliver(db, job)
+			}
+		}()
+	}
+	//после остановки очереди ждём, пока доставки допишут журнал
+	defer workers.Wait()
+	defer close(d.jobs)
+
+	for registration := range d.queue {
+		if d.delivery.Abort.Err() != nil {
+			continue
+		}
+		rows, err := db.Query("SELECT "+webhookColumns+" FROM webhooks WHERE enabled AND (cardinality(targets)=0 OR $1 = ANY(targets))", registration.Target)
+		if err != nil {
+			log.Printf("Failed to load webhooks: %v", err)
+			continue
+		}
+		var subscribed []Webhook
+		for rows.Next() {
+			webhook, err := Scan_Webhook(rows)
+			if err != nil {
+				log.Printf("Failed to scan webhook: %v", err)
+				break
+			}
+			subscribed = append(subscribed, webhook)
+		}
+		rows.Close()
+		if len(subscribed) == 0 {
+			continue
+		}
+
+		notification, err := Build_Notification(registration, renderer.Resolve_Locale())
+		if err != nil {
+			log.Printf("Failed to build webhook for notification %d: %v", registration.Notification_id, err)
+			continue
+		}
+		for _, webhook := range subscribed {
+			event := Webhook_Event{
+				Delivery_id:  newMessageID(),
+				UUID:         registration.UUID,
+				Notification: notification,
+				Data:         json.RawMessage(registration.Notification),
+			}
+			body, err := json.Marshal(event)
+			if err != nil {
+				log.Printf("Failed to encode webhook for notification %d: %v", registration.Notification_id, err)
+				break
+			}
+			d.jobs <- webhookJob{webhook: webhook, event: event, body: body}
+		}
+	}
+}
+
+// Функция одной попытки доставки, возвращает код ответа получателя
+
+func (d *Webhook_Dispatcher) post(job webhookJob) (int, error) {
+	ctx, cancel := context.WithTimeout(d.delivery.Abort, d.client.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, job.webhook.Url, bytes.NewReader(job.body))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Notification_Service")
+	req.Header.Set("X-Webhook-Id", job.event.Delivery_id)
+	req.Header.Set("X-Webhook-Event", job.event.Notification.Target)
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", Sign_Webhook(job.webhook.Secret, timestamp, job.body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("Webhook responded %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// Функция доставки с повторными попытками. Каждая попытка пишется в журнал webhook_deliveries.
+// После WEBHOOK_MAX_FAILURES неудачных доставок подряд подписка отключается.
+
+func (d *Webhook_Dispatcher) deliver(db *sql.DB, job webhookJob) {
+	maxAttempts := Getenv_Int("WEBHOOK_MAX_ATTEMPTS", 5)
+
+	var err error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		started := time.Now()
+		var status int
+		status, err = d.post(job)
+		//сервис останавливается и не успел доставить, прерванная попытка не считается
+		if d.delivery.Abort.Err() != nil {
+			return
+		}
+
+		var statusCode sql.NullInt32
+		var message sql.NullString
+		if status != 0 {
+			statusCode = sql.NullInt32{Int32: int32(status), Valid: true}
+		}
+		if err != nil {
+			message = sql.NullString{String: err.Error(), Valid: true}
+		}
+		_, logErr := db.Exec("INSERT INTO webhook_deliveries (webhook_id, delivery_id, notification_id, attempt, status_code, error, duration_ms) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+			job.webhook.Id, job.event.Delivery_id, job.event.Notification.Notification_id, attempt, statusCode, message, time.Since(started).Milliseconds())
+		if logErr != nil {
+			log.Printf("Failed to log webhook delivery: %v", logErr)
+		}
+
+		if err == nil {
+			if _, err := db.Exec("UPDATE webhooks SET failures=0 WHERE id=$1 AND failures<>0", job.webhook.Id); err != nil {
+				log.Printf("Failed to reset webhook %d failures: %v", job.webhook.Id, err)
+			}
+			return
+		}
+
+		// ошибки клиента, кроме таймаута и ограничения частоты, повторять бессмысленно
+		if status >= 400 && status < 500 && status != http.StatusRequestTimeout && status != http.StatusTooManyRequests {
+			break
+		}
+		if attempt < maxAttempts {
+			select {
+			case <-time.After(Backoff(attempt - 1)):
+			case <-d.delivery.Abort.Done():
+				return
+			}
+		}
+	}
+
+	log.Printf("Failed to deliver webhook %d to %s: %v", job.webhook.Id, job.webhook.Url, err)
+
+	var enabled bool
+	err = db.QueryRow("UPDATE webhooks SET failures=failures+1, enabled=enabled AND failures+1<$2, updated_at=now() WHERE id=$1 RETURNING enabled",
+		job.webhook.Id, Getenv_Int("WEBHOOK_MAX_FAILURES", 10)).Scan(&enabled)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Failed to count webhook %d failure: %v", job.webhook.Id, err)
+		return
+	}
+	if err == nil && !enabled {
+		log.Printf("Webhook %d disabled after too many failed deliveries", job.webhook.Id)
+	}
+}
+
+// Структура запроса создания и изменения подписки, не переданные поля не меняются
+
+type WebhookRequest struct {
+	Url     *string   `json:"url"`
+	Secret  *string   `json:"secret"`
+	Targets *[]string `json:"targets"`
+	Enabled *bool     `json:"enabled"`
+}
+
+// Функция проверки полей запроса подписки
+
+func (request WebhookRequest) validate() error {
+	if request.Url != nil {
+		parsed, err := url.Parse(*request.Url)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return errors.New("url must be an absolute http or https URL")
+		}
+	}
+	if request.Targets != nil {
+		for _, target := range *request.Targets {
+			if !Valid_Target(target) {
+				return fmt.Errorf("Unknown target %q", target)
+			}
+		}
+	}
+	return nil
+}
+
+// Функция получения id подписки из query-параметра
+
+func webhookID(r *http.Request) (int64, error) {
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil || id <= 0 {
+		return 0, errors.New("Invalid id")
+	}
+	return id, nil
+}
+
+// Функция отправки ответа в формате JSON
+
+func writeWebhookJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+// Регистрируем эндпоинты управления вебхуками
+
+func init() {
+	Register_Routes(Webhook_Handlers)
+}
+
+// Функция регистрации эндпоинтов управления вебхуками, доступны только с X-Admin-Token:
+// GET - список подписок или одна по ?id, POST - создание, PUT ?id - изменение
+// (enabled=true сбрасывает счётчик ошибок), DELETE ?id - удаление.
+// Секрет возвращается только при создании; если он не передан, генерируется.
+
+func Webhook_Handlers(router *Router, db *sql.DB) {
+	router.Mount_Func("/api/admin/webhooks", func(w http.ResponseWriter, r *http.Request) {
+		if !Authorize_Admin(r) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			query, args := "SELECT "+webhookColumns+" FROM webhooks ORDER BY id", []interface{}{}
+			if r.URL.Query().Get("id") != "" {
+				id, err := webhookID(r)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				query, args = "SELECT "+webhookColumns+" FROM webhooks WHERE id=$1", []interface{}{id}
+			}
+			rows, err := db.Query(query, args...)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			defer rows.Close()
+			list := []Webhook{}
+			for rows.Next() {
+				webhook, err := Scan_Webhook(rows)
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				webhook.Secret = ""
+				list = append(list, webhook)
+			}
+			writeWebhookJSON(w, http.StatusOK, list)
+
+		case http.MethodPost:
+			var request WebhookRequest
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				http.Error(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+			if request.Url == nil {
+				http.Error(w, "url is required", http.StatusBadRequest)
+				return
+			}
+			if err := request.validate(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			secret := newMessageID() + newMessageID()
+			if request.Secret != nil && *request.Secret != "" {
+				secret = *request.Secret
+			}
+			targets := []string{}
+			if request.Targets != nil {
+				targets = *request.Targets
+			}
+			enabled := request.Enabled == nil || *request.Enabled
+
+			webhook, err := Scan_Webhook(db.QueryRow("INSERT INTO webhooks (url, secret, targets, enabled) VALUES ($1, $2, $3, $4) RETURNING "+webhookColumns,
+				*request.Url, secret, pq.Array(targets), enabled))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			writeWebhookJSON(w, http.StatusCreated, webhook)
+
+		case http.MethodPut:
+			id, err := webhookID(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			var request WebhookRequest
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				http.Error(w, "Invalid request body", http.StatusBadRequest)
+				return
+			}
+			if err := request.validate(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if request.Secret != nil && *request.Secret == "" {
+				http.Error(w, "secret must not be empty", http.StatusBadRequest)
+				return
+			}
+			var targets interface{}
+			if request.Targets != nil {
+				targets = pq.Array(*request.Targets)
+			}
+
+			webhook, err := Scan_Webhook(db.QueryRow("UPDATE webhooks SET url=COALESCE($2, url), secret=COALESCE($3, secret), targets=COALESCE($4, targets), enabled=COALESCE($5, enabled), failures=CASE WHEN $5 THEN 0 ELSE failures END, updated_at=now() WHERE id=$1 RETURNING "+webhookColumns,
+				id, request.Url, request.Secret, targets, request.Enabled))
+			if err == sql.ErrNoRows {
+				http.Error(w, "Webhook not found", http.StatusNotFound)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			webhook.Secret = ""
+			writeWebhookJSON(w, http.StatusOK, webhook)
+
+		case http.MethodDelete:
+			id, err := webhookID(r)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			result, err := db.Exec("DELETE FROM webhooks WHERE id=$1", id)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if deleted, err := result.RowsAffected(); err == nil && deleted == 0 {
+				http.Error(w, "Webhook not found", http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	// Журнал доставок подписки ?id, от новых к старым, не больше ?limit записей
+
+	router.Mount_Func("/api/admin/webhooks/deliveries", func(w http.ResponseWriter, r *http.Request) {
+		if !Authorize_Admin(r) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		id, err := webhookID(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		limit := 100
+		if value := r.URL.Query().Get("limit"); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed <= 0 {
+				http.Error(w, "Invalid limit", http.StatusBadRequest)
+				return
+			}
+			limit = parsed
+		}
+
+		type delivery struct {
+			Id              int64     `json:"id"`
+			Delivery_id     string    `json:"delivery_id"`
+			Notification_id int64     `json:"notification_id"`
+			Attempt         int       `json:"attempt"`
+			Status_code     *int      `json:"status_code"`
+			Error           *string   `json:"error"`
+			Duration_ms     int       `json:"duration_ms"`
+			Created_at      time.Time `json:"created_at"`
+		}
+		rows, err := db.Query("SELECT id, delivery_id, notification_id, attempt, status_code, error, duration_ms, created_at FROM webhook_deliveries WHERE webhook_id=$1 ORDER BY id DESC LIMIT $2", id, limit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		deliveries := []delivery{}
+		for rows.Next() {
+			var d delivery
+			if err := rows.Scan(&d.Id, &d.Delivery_id, &d.Notification_id, &d.Attempt, &d.Status_code, &d.Error, &d.Duration_ms, &d.Created_at); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			deliveries = append(deliveries, d)
+		}
+		writeWebhookJSON(w, http.StatusOK, deliveries)
+	})
+}
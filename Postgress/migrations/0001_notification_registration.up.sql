@@ -0,0 +1,30 @@
+-- Уведомления пользователей
+create table if not exists notification_registration (
+	id bigserial primary key,
+	uuid varchar(36) not null,
+	notification text not null,
+	read boolean not null default false,
+	target text not null,
+	event_id text,
+	created_at timestamptz not null default now()
+);
+
+-- Таблица могла быть создана раньше без части колонок и ограничений
+alter table notification_registration add column if not exists event_id text;
+alter table notification_registration add column if not exists created_at timestamptz not null default now();
+alter table notification_registration alter column id type bigint;
+alter sequence if exists notification_registration_id_seq as bigint;
+alter table notification_registration alter column uuid type varchar(36);
+update notification_registration set read = false where read is null;
+alter table notification_registration alter column read set default false;
+alter table notification_registration alter column read set not null;
+alter table notification_registration alter column uuid set not null;
+alter table notification_registration alter column notification set not null;
+alter table notification_registration alter column target set not null;
+
+-- Выборка страниц /api по курсору
+create index if not exists notification_registration_uuid_id_idx on notification_registration (uuid, id desc);
+-- Счётчики непрочитанных уведомлений
+create index if not exists notification_registration_unread_idx on notification_registration (uuid, target) where not read;
+-- Повторная доставка события не создаёт дубликат
+create unique index if not exists notification_registration_event_uuid_idx on notification_registration (event_id, uuid);
@@ -0,0 +1,7 @@
+create table if not exists notification (
+	id serial primary key,
+	uuid varchar(36),
+	notification text,
+	read boolean default false,
+	target text
+);
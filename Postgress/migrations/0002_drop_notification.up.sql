@@ -0,0 +1,2 @@
+-- Таблица создавалась старыми консьюмерами, но уведомления в неё никогда не записывались
+drop table if exists notification;
@@ -0,0 +1,6 @@
+drop index if exists notification_registration_uuid_created_idx;
+drop trigger if exists notification_registration_updated_at on notification_registration;
+drop function if exists notification_registration_set_updated_at();
+alter table notification_registration drop column if exists event_time;
+alter table notification_registration drop column if exists read_at;
+alter table notification_registration drop column if exists updated_at;
@@ -0,0 +1,22 @@
+-- Время изменения, прочтения и время исходного события
+alter table notification_registration add column if not exists updated_at timestamptz not null default now();
+alter table notification_registration add column if not exists read_at timestamptz;
+alter table notification_registration add column if not exists event_time timestamptz;
+
+update notification_registration set updated_at = created_at;
+update notification_registration set read_at = created_at where read and read_at is null;
+
+-- updated_at обновляется при любом изменении строки
+create or replace function notification_registration_set_updated_at() returns trigger as $$
+begin
+	new.updated_at = now();
+	return new;
+end;
+$$ language plpgsql;
+
+create trigger notification_registration_updated_at
+	before update on notification_registration
+	for each row execute function notification_registration_set_updated_at();
+
+-- Фильтрация /api по времени создания
+create index if not exists notification_registration_uuid_created_idx on notification_registration (uuid, created_at);
@@ -0,0 +1,8 @@
+-- Контакты и роль пользователя из события регистрации
+create table if not exists users (
+	uuid varchar(36) primary key,
+	email text not null,
+	role text not null,
+	created_at timestamptz not null default now(),
+	updated_at timestamptz not null default now()
+);
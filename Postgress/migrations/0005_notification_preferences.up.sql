@@ -0,0 +1,10 @@
+-- Настройки пользователя: включён ли канал доставки для target.
+-- Отсутствие строки означает значение по умолчанию для роли пользователя.
+create table if not exists notification_preferences (
+	uuid varchar(36) not null,
+	target text not null,
+	channel text not null,
+	enabled boolean not null,
+	updated_at timestamptz not null default now(),
+	primary key (uuid, target, channel)
+);
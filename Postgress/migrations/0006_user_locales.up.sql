@@ -0,0 +1,6 @@
+-- Язык уведомлений, выбранный пользователем
+create table if not exists user_locales (
+	uuid varchar(36) primary key,
+	locale text not null,
+	updated_at timestamptz not null default now()
+);
@@ -0,0 +1,10 @@
+-- Токены мобильных устройств для push-уведомлений
+create table if not exists device_tokens (
+	token text primary key,
+	uuid varchar(36) not null,
+	platform text not null check (platform in ('fcm', 'apns')),
+	created_at timestamptz not null default now(),
+	updated_at timestamptz not null default now()
+);
+
+create index if not exists device_tokens_uuid_idx on device_tokens (uuid);
@@ -0,0 +1,27 @@
+-- Подписки внешних систем на уведомления.
+-- Пустой список targets означает подписку на все уведомления.
+create table if not exists webhooks (
+	id bigserial primary key,
+	url text not null,
+	secret text not null,
+	targets text[] not null default '{}',
+	enabled boolean not null default true,
+	failures integer not null default 0,
+	created_at timestamptz not null default now(),
+	updated_at timestamptz not null default now()
+);
+
+-- Журнал попыток доставки
+create table if not exists webhook_deliveries (
+	id bigserial primary key,
+	webhook_id bigint not null references webhooks (id) on delete cascade,
+	delivery_id text not null,
+	notification_id bigint not null,
+	attempt integer not null,
+	status_code integer,
+	error text,
+	duration_ms integer not null,
+	created_at timestamptz not null default now()
+);
+
+create index if not exists webhook_deliveries_webhook_id_idx on webhook_deliveries (webhook_id, id);
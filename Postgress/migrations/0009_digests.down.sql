@@ -0,0 +1,2 @@
+drop table if exists digest_items;
+drop table if exists digest_settings;
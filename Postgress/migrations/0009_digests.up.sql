@@ -0,0 +1,18 @@
+-- Режим сводки: уведомления target копятся и отправляются одной сводкой раз в час или раз в день.
+-- Отсутствие строки означает отправку каждого уведомления сразу.
+create table if not exists digest_settings (
+	uuid varchar(36) not null,
+	target text not null,
+	frequency text not null check (frequency in ('hourly', 'daily')),
+	updated_at timestamptz not null default now(),
+	primary key (uuid, target)
+);
+
+-- Уведомления, ожидающие отправки в сводке
+create table if not exists digest_items (
+	notification_id bigint primary key references notification_registration (id) on delete cascade,
+	frequency text not null,
+	created_at timestamptz not null default now()
+);
+
+create index if not exists digest_items_created_at_idx on digest_items (created_at);
@@ -0,0 +1 @@
+drop index if exists notification_registration_uuid_event_time_idx;
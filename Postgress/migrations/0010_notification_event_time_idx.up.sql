@@ -0,0 +1,2 @@
+-- Сортировка и фильтрация /api по времени события (если оно неизвестно - по времени создания)
+create index if not exists notification_registration_uuid_event_time_idx on notification_registration (uuid, (coalesce(event_time, created_at)), id);
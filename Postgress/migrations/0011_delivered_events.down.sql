@@ -0,0 +1 @@
+drop table if exists delivered_events;
@@ -0,0 +1,8 @@
+-- События, доставленные получателю только по почте, push или вебхуком, без уведомления в приложении.
+-- По ним повторно доставленное сообщение не отправляется второй раз.
+create table if not exists delivered_events (
+	event_id text not null,
+	uuid varchar(36) not null,
+	created_at timestamptz not null default now(),
+	primary key (event_id, uuid)
+);
@@ -0,0 +1,5 @@
+drop index if exists digest_items_digest_id_idx;
+drop index if exists digest_items_pending_idx;
+delete from digest_items where flushed_at is not null;
+alter table digest_items drop column if exists digest_id;
+alter table digest_items drop column if exists flushed_at;
@@ -0,0 +1,7 @@
+-- Отправленные в сводке уведомления остаются в digest_items: по ним они исключаются
+-- из списка и счётчиков непрочитанных, а digest_id связывает их со сводкой.
+alter table digest_items add column if not exists flushed_at timestamptz;
+alter table digest_items add column if not exists digest_id bigint references notification_registration (id) on delete set null;
+
+create index if not exists digest_items_pending_idx on digest_items (created_at) where flushed_at is null;
+create index if not exists digest_items_digest_id_idx on digest_items (digest_id);
@@ -1,8 +0,0 @@
--- Notifications
-create table if not exists notifications (
-	id serial primary key,
-	uuid varchar(60),
-	notification text, 
-	read boolean default false,
-	target text
-);
\ No newline at end of file